@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tai-kun/surreallog/internal/ghc"
+)
+
+const (
+	envGithubOutput      = "GITHUB_OUTPUT"
+	envGithubEnv         = "GITHUB_ENV"
+	envGithubStepSummary = "GITHUB_STEP_SUMMARY"
+)
+
+var fileCommandEnvs = []string{
+	envGithubOutput,
+	envGithubEnv,
+	envGithubStepSummary,
+}
+
+// fileCommands は子プロセスが書き込むファイルコマンドの一時ファイル。
+type fileCommands struct {
+	dir   string
+	paths map[string]string
+	orig  map[string]string // GitHub Actions のステップの中で実行された場合の元のパス
+}
+
+func newFileCommands() (*fileCommands, error) {
+	dir, err := os.MkdirTemp("", "surreallog-")
+	if err != nil {
+		return nil, err
+	}
+
+	fc := &fileCommands{
+		dir:   dir,
+		paths: map[string]string{},
+		orig:  map[string]string{},
+	}
+	for _, name := range fileCommandEnvs {
+		path := filepath.Join(dir, strings.ToLower(name))
+		if err := os.WriteFile(path, []byte{}, 0o600); err != nil {
+			fc.remove()
+			return nil, err
+		}
+
+		fc.paths[name] = path
+	}
+
+	return fc, nil
+}
+
+// inject は env のファイルコマンドの環境変数を一時ファイルのパスに置き換える。
+// 元のパスは、collect で一時ファイルの内容を書き足すために覚えておく。
+func (fc *fileCommands) inject(env []string) []string {
+	out := make([]string, 0, len(env)+len(fileCommandEnvs))
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		if _, ok := fc.paths[name]; !ok {
+			out = append(out, e)
+		} else if value != "" {
+			fc.orig[name] = value
+		}
+	}
+
+	for _, name := range fileCommandEnvs {
+		out = append(out, name+"="+fc.paths[name])
+	}
+
+	return out
+}
+
+// forward は一時ファイルの内容を元のパスに書き足し、外側のランナーにも届ける。
+func (fc *fileCommands) forward(name string, b []byte) error {
+	path, ok := fc.orig[name]
+	if !ok || len(b) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	return errors.Join(err, f.Close())
+}
+
+// collect は子プロセスの終了後に一時ファイルを読み込み、rs に記録する。
+func (fc *fileCommands) collect(rs *runState) error {
+	errs := []error{}
+
+	for _, name := range []string{envGithubOutput, envGithubEnv} {
+		b, err := os.ReadFile(fc.paths[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := fc.forward(name, b); err != nil {
+			errs = append(errs, err)
+		}
+
+		vs, err := ghc.ParseFileCommand(b)
+		if err != nil {
+			errs = append(errs, errors.Join(errors.New(name), err))
+			continue
+		}
+
+		m := rs.outputs
+		if name == envGithubEnv {
+			m = rs.env
+		}
+		for k, v := range vs {
+			rs.set(m, k, v)
+		}
+	}
+
+	b, err := os.ReadFile(fc.paths[envGithubStepSummary])
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		rs.setSummary(string(b))
+		if err := fc.forward(envGithubStepSummary, b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (fc *fileCommands) remove() error {
+	return os.RemoveAll(fc.dir)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFileCommandsForward(t *testing.T) {
+	dir := t.TempDir()
+	orig := filepath.Join(dir, "output")
+	if err := os.WriteFile(orig, []byte("before=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fc, err := newFileCommands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.remove()
+
+	env := fc.inject([]string{"A=1", envGithubOutput + "=" + orig, envGithubEnv + "="})
+	if !slices.Contains(env, "A=1") || slices.Contains(env, envGithubOutput+"="+orig) {
+		t.Fatalf("unexpected env %q", env)
+	}
+
+	if err := os.WriteFile(fc.paths[envGithubOutput], []byte("a<<EOF\nx\nEOF\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fc.paths[envGithubEnv], []byte("b=2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := newRunState()
+	if err := fc.collect(rs); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.outputs["a"] != "x" || rs.env["b"] != "2" {
+		t.Fatalf("outputs = %q, env = %q", rs.outputs, rs.env)
+	}
+
+	b, err := os.ReadFile(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "before=1\na<<EOF\nx\nEOF\n"; string(b) != want {
+		t.Fatalf("original file = %q, want %q", b, want)
+	}
+
+	// 元の値が空の GITHUB_ENV には書き足さない。
+	if _, ok := fc.orig[envGithubEnv]; ok {
+		t.Fatalf("empty %s must not be forwarded", envGithubEnv)
+	}
+}
@@ -0,0 +1,296 @@
+package ansi
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const esc = 0x1b
+
+// Style は SGR シーケンスで指定された文字の装飾。
+// 色は 16 色であれば名前 (red、brightRed など)、それ以外は #rrggbb で表す。
+type Style struct {
+	Fg        string `cbor:"fg,omitempty"`
+	Bg        string `cbor:"bg,omitempty"`
+	Bold      bool   `cbor:"bold,omitempty"`
+	Dim       bool   `cbor:"dim,omitempty"`
+	Italic    bool   `cbor:"italic,omitempty"`
+	Underline bool   `cbor:"underline,omitempty"`
+	Blink     bool   `cbor:"blink,omitempty"`
+	Inverse   bool   `cbor:"inverse,omitempty"`
+	Hidden    bool   `cbor:"hidden,omitempty"`
+	Strike    bool   `cbor:"strike,omitempty"`
+}
+
+// Span は装飾された範囲。Start と End はエスケープシーケンスを取り除いた
+// 文字列での文字 (rune) 単位の位置で、End は含まない。
+type Span struct {
+	Start int `cbor:"start"`
+	End   int `cbor:"end"`
+	Style
+}
+
+// sequence は b[i] から始まるエスケープシーケンスの長さと、
+// SGR シーケンスであればそのパラメーターを返す。
+func sequence(b []byte, i int) (int, string, bool) {
+	if i+1 >= len(b) {
+		return len(b) - i, "", false
+	}
+
+	switch c := b[i+1]; {
+	case c == '[': // CSI
+		for j := i + 2; j < len(b); j++ {
+			if b[j] >= 0x40 && b[j] <= 0x7e {
+				return j + 1 - i, string(b[i+2 : j]), b[j] == 'm'
+			}
+		}
+		return len(b) - i, "", false
+
+	case c == ']', c == 'P', c == 'X', c == '^', c == '_': // OSC、DCS、SOS、PM、APC
+		for j := i + 2; j < len(b); j++ {
+			switch {
+			case b[j] == 0x07 && c == ']':
+				return j + 1 - i, "", false
+			case b[j] == esc && j+1 < len(b) && b[j+1] == '\\':
+				return j + 2 - i, "", false
+			}
+		}
+		return len(b) - i, "", false
+
+	case c >= 0x20 && c <= 0x2f: // nF (文字集合の指定など)
+		for j := i + 2; j < len(b); j++ {
+			if b[j] >= 0x30 && b[j] <= 0x7e {
+				return j + 1 - i, "", false
+			}
+		}
+		return len(b) - i, "", false
+
+	default:
+		return 2, "", false
+	}
+}
+
+// Strip はエスケープシーケンスを取り除く。
+func Strip(b []byte) []byte {
+	out, _ := parse(b, false)
+	return out
+}
+
+// Parse はエスケープシーケンスを取り除いた文字列と、SGR シーケンスによる装飾の範囲を返す。
+func Parse(b []byte) ([]byte, []Span) {
+	return parse(b, true)
+}
+
+func parse(b []byte, styles bool) ([]byte, []Span) {
+	out := make([]byte, 0, len(b))
+	spans := []Span{}
+	cur := Style{}
+	pos := 0   // out の文字数
+	start := 0 // cur が始まった位置
+
+	closeSpan := func() {
+		if cur == (Style{}) || pos == start {
+			return
+		}
+
+		if n := len(spans); n > 0 && spans[n-1].End == start && spans[n-1].Style == cur {
+			spans[n-1].End = pos
+			return
+		}
+
+		spans = append(spans, Span{Start: start, End: pos, Style: cur})
+	}
+
+	i := 0
+	for i < len(b) {
+		j := i
+		for j < len(b) && b[j] != esc {
+			j++
+		}
+		out = append(out, b[i:j]...)
+		pos += utf8.RuneCount(b[i:j])
+		if j == len(b) {
+			break
+		}
+
+		n, params, sgr := sequence(b, j)
+		if styles && sgr {
+			next := apply(cur, params)
+			if next != cur {
+				closeSpan()
+				cur = next
+				start = pos
+			}
+		}
+		i = j + n
+	}
+
+	if !styles {
+		return out, nil
+	}
+
+	closeSpan()
+
+	return out, spans
+}
+
+var colorNames = []string{
+	"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white",
+	"brightBlack", "brightRed", "brightGreen", "brightYellow",
+	"brightBlue", "brightMagenta", "brightCyan", "brightWhite",
+}
+
+func rgb(r, g, b int) string {
+	const hex = "0123456789abcdef"
+	return string([]byte{
+		'#',
+		hex[r>>4&0xf], hex[r&0xf],
+		hex[g>>4&0xf], hex[g&0xf],
+		hex[b>>4&0xf], hex[b&0xf],
+	})
+}
+
+// color256 は 256 色のパレットの番号を色に変換する。
+func color256(n int) string {
+	switch {
+	case n < 16:
+		return colorNames[n]
+	case n < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return rgb(levels[n/36], levels[n/6%6], levels[n%6])
+	default:
+		v := 8 + (n-232)*10
+		return rgb(v, v, v)
+	}
+}
+
+func atoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return -1
+	}
+
+	return n
+}
+
+// extended は 38 または 48 に続く色の指定を解釈し、色と消費したパラメーターの数を返す。
+func extended(ps []string) (string, int) {
+	if len(ps) == 0 {
+		return "", 0
+	}
+
+	switch atoi(ps[0]) {
+	case 5:
+		if len(ps) < 2 {
+			return "", len(ps)
+		}
+		if n := atoi(ps[1]); n >= 0 && n < 256 {
+			return color256(n), 2
+		}
+		return "", 2
+
+	case 2:
+		if len(ps) < 4 {
+			return "", len(ps)
+		}
+		r, g, b := atoi(ps[1]), atoi(ps[2]), atoi(ps[3])
+		if r < 0 || r > 255 || g < 0 || g > 255 || b < 0 || b > 255 {
+			return "", 4
+		}
+		return rgb(r, g, b), 4
+
+	default:
+		return "", 1
+	}
+}
+
+// apply は SGR シーケンスのパラメーターを s に適用する。
+func apply(s Style, params string) Style {
+	ps := strings.Split(params, ";")
+	for i := 0; i < len(ps); i++ {
+		p := ps[i]
+		if strings.Contains(p, ":") {
+			// 38:2::r:g:b のようなサブパラメーター
+			sub := strings.Split(p, ":")
+			if c := atoi(sub[0]); c == 38 || c == 48 {
+				rest := sub[1:]
+				if len(rest) == 5 && atoi(rest[0]) == 2 {
+					rest = append(rest[:1], rest[2:]...) // 色空間の ID を除く
+				}
+				color, _ := extended(rest)
+				if c == 38 {
+					s.Fg = color
+				} else {
+					s.Bg = color
+				}
+				continue
+			}
+			p = sub[0]
+		}
+
+		code := 0
+		if p != "" {
+			code = atoi(p)
+		}
+
+		switch {
+		case code == 0:
+			s = Style{}
+		case code == 1:
+			s.Bold = true
+		case code == 2:
+			s.Dim = true
+		case code == 3:
+			s.Italic = true
+		case code == 4:
+			s.Underline = true
+		case code == 5, code == 6:
+			s.Blink = true
+		case code == 7:
+			s.Inverse = true
+		case code == 8:
+			s.Hidden = true
+		case code == 9:
+			s.Strike = true
+		case code == 21, code == 22:
+			s.Bold = false
+			s.Dim = false
+		case code == 23:
+			s.Italic = false
+		case code == 24:
+			s.Underline = false
+		case code == 25:
+			s.Blink = false
+		case code == 27:
+			s.Inverse = false
+		case code == 28:
+			s.Hidden = false
+		case code == 29:
+			s.Strike = false
+		case code >= 30 && code <= 37:
+			s.Fg = colorNames[code-30]
+		case code == 38, code == 48:
+			color, n := extended(ps[i+1:])
+			i += n
+			if code == 38 {
+				s.Fg = color
+			} else {
+				s.Bg = color
+			}
+		case code == 39:
+			s.Fg = ""
+		case code >= 40 && code <= 47:
+			s.Bg = colorNames[code-40]
+		case code == 49:
+			s.Bg = ""
+		case code >= 90 && code <= 97:
+			s.Fg = colorNames[code-90+8]
+		case code >= 100 && code <= 107:
+			s.Bg = colorNames[code-100+8]
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,101 @@
+package ansi
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		text  string
+		spans []Span
+	}{
+		{
+			name:  "plain",
+			in:    "hello",
+			text:  "hello",
+			spans: []Span{},
+		},
+		{
+			name:  "16 colors",
+			in:    "\x1b[31merror\x1b[0m: x",
+			text:  "error: x",
+			spans: []Span{{Start: 0, End: 5, Style: Style{Fg: "red"}}},
+		},
+		{
+			name: "bright and background",
+			in:   "\x1b[1;93;44mA\x1b[22mB\x1b[49mC\x1b[m",
+			text: "ABC",
+			spans: []Span{
+				{Start: 0, End: 1, Style: Style{Fg: "brightYellow", Bg: "blue", Bold: true}},
+				{Start: 1, End: 2, Style: Style{Fg: "brightYellow", Bg: "blue"}},
+				{Start: 2, End: 3, Style: Style{Fg: "brightYellow"}},
+			},
+		},
+		{
+			name:  "256 colors",
+			in:    "\x1b[38;5;196mx\x1b[38;5;244my\x1b[38;5;9mz\x1b[0m",
+			text:  "xyz",
+			spans: []Span{{Start: 0, End: 1, Style: Style{Fg: "#ff0000"}}, {Start: 1, End: 2, Style: Style{Fg: "#808080"}}, {Start: 2, End: 3, Style: Style{Fg: "brightRed"}}},
+		},
+		{
+			name:  "truecolor",
+			in:    "\x1b[48;2;1;2;255mx\x1b[38:2::16:32:48my\x1b[0m",
+			text:  "xy",
+			spans: []Span{{Start: 0, End: 1, Style: Style{Bg: "#0102ff"}}, {Start: 1, End: 2, Style: Style{Fg: "#102030", Bg: "#0102ff"}}},
+		},
+		{
+			name:  "positions are runes",
+			in:    "あ\x1b[4mいう\x1b[24mえ",
+			text:  "あいうえ",
+			spans: []Span{{Start: 1, End: 3, Style: Style{Underline: true}}},
+		},
+		{
+			name:  "same style is merged",
+			in:    "\x1b[31ma\x1b[31mb\x1b[0m",
+			text:  "ab",
+			spans: []Span{{Start: 0, End: 2, Style: Style{Fg: "red"}}},
+		},
+		{
+			name:  "unterminated style",
+			in:    "\x1b[7mab",
+			text:  "ab",
+			spans: []Span{{Start: 0, End: 2, Style: Style{Inverse: true}}},
+		},
+		{
+			name:  "other sequences",
+			in:    "\x1b[2K\x1b]0;title\x07a\x1b]8;;http://x\x1b\\b\x1b(Bc\x1b=d",
+			text:  "abcd",
+			spans: []Span{},
+		},
+		{
+			name:  "truncated sequence",
+			in:    "a\x1b[31",
+			text:  "a",
+			spans: []Span{},
+		},
+		{
+			name:  "invalid colors",
+			in:    "\x1b[38;5;300ma\x1b[38;2;1;2mb",
+			text:  "ab",
+			spans: []Span{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, spans := Parse([]byte(tt.in))
+			if string(text) != tt.text {
+				t.Fatalf("text = %q, want %q", text, tt.text)
+			}
+			if !slices.Equal(spans, tt.spans) {
+				t.Fatalf("spans = %+v, want %+v", spans, tt.spans)
+			}
+			if s := Strip([]byte(tt.in)); string(s) != tt.text {
+				t.Fatalf("Strip = %q, want %q", s, tt.text)
+			}
+		})
+	}
+}
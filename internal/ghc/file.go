@@ -0,0 +1,72 @@
+package ghc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNoName         = errors.New("name must not be empty")
+	ErrNoDelimiter    = errors.New("matching delimiter not found")
+	ErrInvalidCommand = errors.New("invalid format")
+)
+
+// ParseFileCommand は GITHUB_OUTPUT や GITHUB_ENV に書き込まれた
+// name=value と name<<DELIMITER 形式の内容を解析する。
+//
+// https://github.com/actions/runner/blob/v2.320.0/src/Runner.Worker/FileCommandManager.cs
+func ParseFileCommand(b []byte) (map[string]string, error) {
+	out := map[string]string{}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	lines := strings.Split(string(b), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		hd := strings.Index(line, "<<")
+		switch {
+		case eq >= 0 && (hd < 0 || eq < hd):
+			name := line[:eq]
+			if name == "" {
+				return nil, ErrNoName
+			}
+
+			out[name] = line[eq+1:]
+
+		case hd >= 0 && (eq < 0 || hd < eq):
+			name := line[:hd]
+			delim := line[hd+2:]
+			if name == "" {
+				return nil, ErrNoName
+			}
+			if delim == "" {
+				return nil, ErrNoDelimiter
+			}
+
+			value := []string{}
+			found := false
+			for i++; i < len(lines); i++ {
+				if lines[i] == delim {
+					found = true
+					break
+				}
+
+				value = append(value, lines[i])
+			}
+			if !found {
+				return nil, errors.Join(ErrNoDelimiter, errors.New(delim))
+			}
+
+			out[name] = strings.Join(value, "\n")
+
+		default:
+			return nil, errors.Join(ErrInvalidCommand, errors.New(line))
+		}
+	}
+
+	return out, nil
+}
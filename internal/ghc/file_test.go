@@ -0,0 +1,100 @@
+package ghc
+
+import (
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestParseFileCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string]string
+		err  error
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: map[string]string{},
+		},
+		{
+			name: "name=value",
+			in:   "a=1\nb=x=y\nc=\n",
+			want: map[string]string{"a": "1", "b": "x=y", "c": ""},
+		},
+		{
+			name: "heredoc",
+			in:   "a<<EOF\nline 1\nline 2\nEOF\nb=2\n",
+			want: map[string]string{"a": "line 1\nline 2", "b": "2"},
+		},
+		{
+			name: "empty heredoc",
+			in:   "a<<EOF\nEOF\n",
+			want: map[string]string{"a": ""},
+		},
+		{
+			name: "crlf",
+			in:   "a=1\r\nb<<EOF\r\nx\r\nEOF\r\n",
+			want: map[string]string{"a": "1", "b": "x"},
+		},
+		{
+			name: "= before <<",
+			in:   "a=b<<c\n",
+			want: map[string]string{"a": "b<<c"},
+		},
+		{
+			name: "<< before =",
+			in:   "a<<=\nx\n=\n",
+			want: map[string]string{"a": "x"},
+		},
+		{
+			name: "later value wins",
+			in:   "a=1\na=2\n",
+			want: map[string]string{"a": "2"},
+		},
+		{
+			name: "no name",
+			in:   "=1\n",
+			err:  ErrNoName,
+		},
+		{
+			name: "no heredoc name",
+			in:   "<<EOF\nEOF\n",
+			err:  ErrNoName,
+		},
+		{
+			name: "no delimiter",
+			in:   "a<<\n",
+			err:  ErrNoDelimiter,
+		},
+		{
+			name: "unterminated heredoc",
+			in:   "a<<EOF\nx\n",
+			err:  ErrNoDelimiter,
+		},
+		{
+			name: "invalid line",
+			in:   "a\n",
+			err:  ErrInvalidCommand,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFileCommand([]byte(tt.in))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -233,6 +233,7 @@ func unescapeData(s []byte) []byte {
 	if len(s) == 0 {
 		return []byte{}
 	}
+	s = bytes.Clone(s)
 	for i := 0; i < len(s); i++ {
 		if s[i] == '%' && i < len(s)-2 {
 			switch s[i+1] {
@@ -259,6 +260,7 @@ func unescapeProperty(s []byte) []byte {
 	if len(s) == 0 {
 		return nil
 	}
+	s = bytes.Clone(s)
 	for i := 0; i < len(s); i++ {
 		if s[i] == '%' && i < len(s)-2 {
 			switch s[i+1] {
@@ -0,0 +1,284 @@
+package ghc
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// https://github.com/actions/toolkit/blob/main/docs/problem-matchers.md
+type MatcherPattern struct {
+	Regexp    string `json:"regexp"`
+	File      int    `json:"file"`
+	FromPath  int    `json:"fromPath"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine"`
+	EndColumn int    `json:"endColumn"`
+	Severity  int    `json:"severity"`
+	Code      int    `json:"code"`
+	Message   int    `json:"message"`
+	Loop      bool   `json:"loop"`
+	re        *regexp.Regexp
+}
+
+type MatcherConfig struct {
+	Owner    string            `json:"owner"`
+	Severity string            `json:"severity"`
+	Pattern  []*MatcherPattern `json:"pattern"`
+}
+
+type matcherFile struct {
+	ProblemMatcher []*MatcherConfig `json:"problemMatcher"`
+}
+
+func (c *MatcherConfig) validate() error {
+	if c.Owner == "" {
+		return errors.New("problem matcher owner must not be empty")
+	}
+
+	if len(c.Pattern) == 0 {
+		return errors.New("problem matcher " + c.Owner + " has no pattern")
+	}
+
+	message := false
+	for i, p := range c.Pattern {
+		if p.Regexp == "" {
+			return errors.New("problem matcher " + c.Owner + " has an empty regexp")
+		}
+
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return err
+		}
+		p.re = re
+
+		if p.Loop && (len(c.Pattern) == 1 || i != len(c.Pattern)-1) {
+			return errors.New(
+				"problem matcher " + c.Owner +
+					": loop is only allowed on the last of multiple patterns",
+			)
+		}
+
+		if p.Message > 0 {
+			message = true
+		}
+	}
+
+	if !message {
+		return errors.New("problem matcher " + c.Owner + " has no message group")
+	}
+
+	return nil
+}
+
+// Matcher は 1 つの問題マッチャーと複数行パターンの途中の状態を持つ。
+type Matcher struct {
+	config *MatcherConfig
+	state  []map[string]string
+}
+
+func newMatcher(c *MatcherConfig) *Matcher {
+	return &Matcher{
+		config: c,
+		state:  make([]map[string]string, len(c.Pattern)),
+	}
+}
+
+func (m *Matcher) reset() {
+	clear(m.state)
+}
+
+func capture(
+	prev map[string]string,
+	p *MatcherPattern,
+	groups []string,
+) map[string]string {
+	out := map[string]string{}
+	for k, v := range prev {
+		out[k] = v
+	}
+
+	set := func(k string, i int) {
+		if i > 0 && i < len(groups) && groups[i] != "" {
+			out[k] = groups[i]
+		}
+	}
+	set("file", p.File)
+	set("fromPath", p.FromPath)
+	set("line", p.Line)
+	set("col", p.Column)
+	set("endLine", p.EndLine)
+	set("endColumn", p.EndColumn)
+	set("severity", p.Severity)
+	set("code", p.Code)
+	set("message", p.Message)
+
+	return out
+}
+
+// Match は 1 行を照合し、問題が見つかった場合はその値を返す。
+// 複数行パターンでは最後のパターンに一致したときに、それまでの値と合わせて返す。
+//
+// https://github.com/actions/runner/blob/v2.320.0/src/Runner.Worker/IssueMatcher.cs
+func (m *Matcher) Match(line string) map[string]string {
+	ps := m.config.Pattern
+	if len(ps) == 1 {
+		if g := ps[0].re.FindStringSubmatch(line); g != nil {
+			return capture(nil, ps[0], g)
+		}
+
+		return nil
+	}
+
+	for i := len(ps) - 1; i >= 0; i-- {
+		var running map[string]string
+		if i > 0 {
+			running = m.state[i-1]
+			if running == nil {
+				continue
+			}
+		}
+
+		p := ps[i]
+		last := i == len(ps)-1
+		g := p.re.FindStringSubmatch(line)
+		if g == nil {
+			// 最後のパターンに一致しなければ、途中まで一致していた問題は捨てる。
+			if !last {
+				m.state[i] = nil
+			} else {
+				m.state[i-1] = nil
+			}
+			continue
+		}
+
+		if !last {
+			m.state[i] = capture(running, p, g)
+			continue
+		}
+
+		m.reset()
+		if p.Loop {
+			m.state[i-1] = running
+		}
+
+		return capture(running, p, g)
+	}
+
+	return nil
+}
+
+// Matchers は ::add-matcher:: で登録された問題マッチャーの一覧。
+type Matchers struct {
+	list []*Matcher
+	mu   sync.Mutex
+}
+
+// Add は問題マッチャーの JSON ファイルを読み込んで登録する。
+// 同じ owner の問題マッチャーは置き換える。
+func (ms *Matchers) Add(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f matcherFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	for _, c := range f.ProblemMatcher {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, c := range f.ProblemMatcher {
+		ms.remove(c.Owner)
+		ms.list = append(ms.list, newMatcher(c))
+	}
+
+	return nil
+}
+
+func (ms *Matchers) Remove(owner string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.remove(owner)
+}
+
+func (ms *Matchers) remove(owner string) {
+	list := ms.list[:0]
+	for _, m := range ms.list {
+		if !strings.EqualFold(m.config.Owner, owner) {
+			list = append(list, m)
+		}
+	}
+	ms.list = list
+}
+
+// Match は登録された順に問題マッチャーを照合し、最初に一致したものを
+// notice、warning、error のいずれかのコマンドとして返す。
+func (ms *Matchers) Match(line []byte) *GHC {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s := string(line)
+	for i, m := range ms.list {
+		v := m.Match(s)
+		if v == nil {
+			continue
+		}
+
+		for j, o := range ms.list {
+			if j != i {
+				o.reset()
+			}
+		}
+
+		severity := v["severity"]
+		if severity == "" {
+			severity = m.config.Severity
+		}
+
+		data := map[string][]byte{}
+		for _, k := range matchedOptions {
+			if x, ok := v[k]; ok {
+				data[k] = []byte(x)
+			}
+		}
+
+		return &GHC{
+			Name: normalizeSeverity(severity),
+			Data: []byte(v["message"]),
+			Opts: &GHCOptions{
+				data: data,
+				defs: map[string]func(s []byte) (any, error){},
+			},
+		}
+	}
+
+	return nil
+}
+
+var matchedOptions = []string{"file", "fromPath", "line", "col", "endLine", "endColumn", "code"}
+
+func normalizeSeverity(s string) string {
+	s = strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, "warn"):
+		return "warning"
+	case s == "notice", s == "info":
+		return "notice"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,154 @@
+package ghc
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatcherMatch(t *testing.T) {
+	fileSevErr := func(loop bool) []*MatcherPattern {
+		return []*MatcherPattern{
+			{Regexp: `^FILE (\S+)$`, File: 1},
+			{Regexp: `^SEV (\w+)$`, Severity: 1},
+			{Regexp: `^  ERR (.+)$`, Message: 1, Loop: loop},
+		}
+	}
+
+	type step struct {
+		line string
+		want map[string]string // nil なら一致しない
+	}
+
+	tests := []struct {
+		name     string
+		patterns []*MatcherPattern
+		steps    []step
+	}{
+		{
+			name: "single pattern",
+			patterns: []*MatcherPattern{
+				{Regexp: `^(.+):(\d+):(\d+): (.+)$`, File: 1, Line: 2, Column: 3, Message: 4},
+			},
+			steps: []step{
+				{"main.go:3:7: undefined: x", map[string]string{
+					"file": "main.go", "line": "3", "col": "7", "message": "undefined: x",
+				}},
+				{"ok", nil},
+			},
+		},
+		{
+			name:     "multiple patterns",
+			patterns: fileSevErr(false),
+			steps: []step{
+				{"FILE a.go", nil},
+				{"SEV warning", nil},
+				{"  ERR one", map[string]string{"file": "a.go", "severity": "warning", "message": "one"}},
+				{"  ERR two", nil},
+			},
+		},
+		{
+			name:     "broken sequence",
+			patterns: fileSevErr(false),
+			steps: []step{
+				{"FILE a.go", nil},
+				{"something else", nil},
+				{"SEV warning", nil},
+				{"  ERR one", nil},
+			},
+		},
+		{
+			name:     "loop",
+			patterns: fileSevErr(true),
+			steps: []step{
+				{"FILE a.go", nil},
+				{"SEV warning", nil},
+				{"  ERR one", map[string]string{"file": "a.go", "severity": "warning", "message": "one"}},
+				{"  ERR two", map[string]string{"file": "a.go", "severity": "warning", "message": "two"}},
+			},
+		},
+		{
+			name:     "loop ends on unrelated line",
+			patterns: fileSevErr(true),
+			steps: []step{
+				{"FILE a.go", nil},
+				{"SEV warning", nil},
+				{"  ERR one", map[string]string{"file": "a.go", "severity": "warning", "message": "one"}},
+				{"build finished", nil},
+				{"  ERR stray", nil},
+			},
+		},
+		{
+			name:     "restart after loop",
+			patterns: fileSevErr(true),
+			steps: []step{
+				{"FILE a.go", nil},
+				{"SEV warning", nil},
+				{"  ERR one", map[string]string{"file": "a.go", "severity": "warning", "message": "one"}},
+				{"FILE b.go", nil},
+				{"SEV error", nil},
+				{"  ERR two", map[string]string{"file": "b.go", "severity": "error", "message": "two"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &MatcherConfig{Owner: "test", Pattern: tt.patterns}
+			if err := c.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			m := newMatcher(c)
+			for i, st := range tt.steps {
+				got := m.Match(st.line)
+				if (got == nil) != (st.want == nil) || !maps.Equal(got, st.want) {
+					t.Fatalf("step %d (%q): got %q, want %q", i, st.line, got, st.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchersMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matcher.json")
+	err := os.WriteFile(path, []byte(`{
+  "problemMatcher": [{
+    "owner": "test",
+    "pattern": [{
+      "regexp": "^(.+):(\\d+): (warning|error) (\\w+): (.+) \\[(.+)\\]$",
+      "file": 1, "line": 2, "severity": 3, "code": 4, "message": 5, "fromPath": 6
+    }]
+  }]
+}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ms Matchers
+	if err := ms.Add(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c := ms.Match([]byte("a.go:3: warning W1: unused [pkg/go.mod]"))
+	if c == nil {
+		t.Fatal("got no match")
+	}
+	if c.Name != "warning" || string(c.Data) != "unused" {
+		t.Fatalf("got %q %q, want warning unused", c.Name, c.Data)
+	}
+
+	want := map[string]string{"file": "a.go", "fromPath": "pkg/go.mod", "line": "3", "code": "W1"}
+	got := map[string]string{}
+	for k, v := range c.Opts.data {
+		got[k] = string(v)
+	}
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if c := ms.Match([]byte("ok")); c != nil {
+		t.Fatalf("got %q, want no match", c.Name)
+	}
+}
@@ -0,0 +1,29 @@
+package pty
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+var ErrUnsupported = errors.New("pseudo-terminal is not supported on this platform")
+
+// Reader は擬似端末のマスター側から読み込む。スレーブ側がすべて閉じられると
+// Linux では EIO が返るため、これを io.EOF として扱う。
+type Reader struct {
+	f *os.File
+}
+
+func NewReader(f *os.File) *Reader {
+	return &Reader{f: f}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package pty
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Open は擬似端末を開き、マスター側とスレーブ側を返す。
+func Open() (*os.File, *os.File, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(ptmx, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	var n uint32
+	if err := ioctl(ptmx, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	name := "/dev/pts/" + strconv.FormatUint(uint64(n), 10)
+	tty, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	return ptmx, tty, nil
+}
+
+type winsize struct {
+	rows uint16
+	cols uint16
+	x    uint16
+	y    uint16
+}
+
+// Setsize は擬似端末のウィンドウサイズを設定する。
+func Setsize(f *os.File, cols, rows uint16) error {
+	ws := &winsize{rows: rows, cols: cols}
+	return ioctl(f, syscall.TIOCSWINSZ, unsafe.Pointer(ws))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pty
+
+import "os"
+
+func Open() (*os.File, *os.File, error) {
+	return nil, nil, ErrUnsupported
+}
+
+func Setsize(f *os.File, cols, rows uint16) error {
+	return ErrUnsupported
+}
@@ -1,9 +1,9 @@
 package sdb
 
 import (
+	"context"
 	"errors"
 	"log"
-	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -66,13 +66,39 @@ func (s *serial) reset() {
 	s.cntr = 0
 }
 
+var (
+	ErrClosed       = errors.New("connection is closed")
+	ErrDisconnected = errors.New("connection is lost")
+)
+
+// Reconnect は切断時の再接続の設定。
+type Reconnect struct {
+	// 最初の再接続を試みるまでの待ち時間。失敗するたびに倍になる。
+	Delay time.Duration
+	// 再接続を試みるまでの待ち時間の上限。
+	MaxDelay time.Duration
+	// 再接続を試みる最大回数。0 以下の場合は無制限。
+	MaxAttempts int
+}
+
 type SDB struct {
-	id        *serial
-	ws        *websocket.Conn
-	endpoint  string
-	CloseErr  error
-	CloseChan chan bool
+	id           *serial
+	ws           *websocket.Conn
+	endpoint     string
+	auth         *systemAuth
+	use          *[2]string
+	ready        chan bool // 接続中は close されている
+	reconnecting bool
+	onDisconnect func(err error)
+	onReconnect  func()
+	onGiveUp     func(err error)
+	CloseErr     error
+	CloseChan    chan bool
+	Reconnect    *Reconnect
+	// コンテキストに期限がない rpc に適用する待ち時間。0 の場合は 5 秒。
+	Timeout   time.Duration
 	respChans map[int]chan rpcResponse
+	notify    *notifier
 	wsLock    sync.Mutex
 	respLock  sync.RWMutex
 }
@@ -81,11 +107,50 @@ func NewSDB() *SDB {
 	return &SDB{}
 }
 
+const defaultTimeout = 5 * time.Second
+
+func dial(ctx context.Context, endpoint string) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	dialer.Subprotocols = []string{"cbor"}
+	ws, _, err := dialer.DialContext(ctx, endpoint, nil)
+
+	return ws, err
+}
+
+func (s *SDB) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// withTimeout は期限のないコンテキストに既定の待ち時間を設定する。
+func (s *SDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.timeout())
+}
+
+func closedChan() chan bool {
+	c := make(chan bool)
+	close(c)
+
+	return c
+}
+
 func (s *SDB) Connect(endpoint string) error {
+	return s.ConnectContext(context.Background(), endpoint)
+}
+
+func (s *SDB) ConnectContext(ctx context.Context, endpoint string) error {
 	s.wsLock.Lock()
 	defer s.wsLock.Unlock()
 
-	if s.ws != nil {
+	if s.CloseChan != nil {
 		if s.endpoint == endpoint {
 			return nil
 		}
@@ -95,10 +160,10 @@ func (s *SDB) Connect(endpoint string) error {
 		)
 	}
 
-	dialer := websocket.DefaultDialer
-	dialer.EnableCompression = true
-	dialer.Subprotocols = append(dialer.Subprotocols, "cbor")
-	ws, _, err := dialer.Dial(endpoint, nil)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	ws, err := dial(ctx, endpoint)
 	if err != nil {
 		return err
 	}
@@ -108,33 +173,79 @@ func (s *SDB) Connect(endpoint string) error {
 	}
 	s.ws = ws
 	s.endpoint = endpoint
+	s.ready = closedChan()
+	s.reconnecting = false
 	s.CloseErr = nil
 	s.CloseChan = make(chan bool)
+	s.respLock.Lock()
 	s.respChans = make(map[int]chan rpcResponse)
-	go s.listen()
+	s.respLock.Unlock()
+	go s.listen(ws, s.CloseChan)
 
 	return nil
 }
 
+// OnDisconnect は接続が失われたときに呼ばれる関数を登録する。
+func (s *SDB) OnDisconnect(fn func(err error)) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	s.onDisconnect = fn
+}
+
+// OnReconnect は再接続して signin と use をやり直した後に呼ばれる関数を登録する。
+func (s *SDB) OnReconnect(fn func()) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	s.onReconnect = fn
+}
+
+// OnGiveUp は再接続を諦めたときに呼ばれる関数を登録する。以降の rpc はすぐに失敗する。
+func (s *SDB) OnGiveUp(fn func(err error)) {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	s.onGiveUp = fn
+}
+
+// Reconnecting は接続が失われ、再接続を試みている間 true を返す。
+func (s *SDB) Reconnecting() bool {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	return s.reconnecting
+}
+
 func (s *SDB) Close() error {
 	s.wsLock.Lock()
 
-	if s.ws == nil {
+	if s.CloseChan == nil {
 		s.wsLock.Unlock()
 		return nil
 	}
 
+	ws := s.ws
 	defer func() {
 		s.id.reset()
 		s.ws = nil
 		s.endpoint = ""
+		s.auth = nil
+		s.use = nil
 		s.CloseChan = nil
+		s.respLock.Lock()
 		s.respChans = nil
+		s.notify = nil
+		s.respLock.Unlock()
 		s.wsLock.Unlock()
 	}()
 	close(s.CloseChan)
+	if ws == nil {
+		return nil
+	}
+
 	errs := make([]error, 0)
-	err := s.ws.WriteMessage(
+	err := ws.WriteMessage(
 		websocket.CloseMessage,
 		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
 	)
@@ -142,7 +253,7 @@ func (s *SDB) Close() error {
 		errs = append(errs, err)
 	}
 
-	if err := s.ws.Close(); err != nil {
+	if err := ws.Close(); err != nil {
 		if websocket.IsCloseError(
 			err,
 			// 正常系
@@ -167,22 +278,52 @@ func (s *SDB) Close() error {
 }
 
 func (s *SDB) Use(ns, db string) error {
-	_, err := s.rpc("use", [2]string{ns, db})
+	return s.UseContext(context.Background(), ns, db)
+}
+
+func (s *SDB) UseContext(ctx context.Context, ns, db string) error {
+	use := [2]string{ns, db}
+	if _, err := s.rpc(ctx, "use", use); err != nil {
+		return err
+	}
+
+	s.wsLock.Lock()
+	s.use = &use
+	s.wsLock.Unlock()
 
-	return err
+	return nil
 }
 
 func (s *SDB) Signin(user, pass string) error {
-	_, err := s.rpc("signin", [1]systemAuth{{
+	return s.SigninContext(context.Background(), user, pass)
+}
+
+func (s *SDB) SigninContext(ctx context.Context, user, pass string) error {
+	auth := systemAuth{
 		User: user,
 		Pass: pass,
-	}})
+	}
+	if _, err := s.rpc(ctx, "signin", [1]systemAuth{auth}); err != nil {
+		return err
+	}
+
+	s.wsLock.Lock()
+	s.auth = &auth
+	s.wsLock.Unlock()
 
-	return err
+	return nil
 }
 
 func (s *SDB) Query(query string, vars any) (*[]queryResult, error) {
-	msg, err := s.rpc("query", [2]any{query, vars})
+	return s.QueryContext(context.Background(), query, vars)
+}
+
+func (s *SDB) QueryContext(
+	ctx context.Context,
+	query string,
+	vars any,
+) (*[]queryResult, error) {
+	msg, err := s.rpc(ctx, "query", [2]any{query, vars})
 	if err != nil {
 		return nil, err
 	}
@@ -195,46 +336,330 @@ func (s *SDB) Query(query string, vars any) (*[]queryResult, error) {
 	return &res, nil
 }
 
-func (s *SDB) listen() {
+func (s *SDB) listen(ws *websocket.Conn, closeChan chan bool) {
 	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			select {
+			case <-closeChan:
+			default:
+				s.disconnect(ws, closeChan, err)
+			}
+			return
+		}
+
+		var resp rpcResponse
+		err = cbor.Unmarshal(data, &resp)
+		if err != nil {
+			log.Println("decode cbor failed:", err)
+			continue
+		}
+
+		// id のないメッセージは LIVE SELECT の通知。
+		if resp.Id == 0 {
+			s.dispatch(resp.Result)
+			continue
+		}
+
+		respChan, exists := s.getChan(resp.Id)
+		if exists {
+			respChan <- resp
+		}
+	}
+}
+
+// Notification は LIVE SELECT の通知。
+type Notification struct {
+	// LIVE SELECT が返した ID
+	ID     UUID             `cbor:"id"`
+	Action string           `cbor:"action"` // "CREATE" | "UPDATE" | "DELETE" | "KILLED"
+	Record *cbor.RawMessage `cbor:"record"`
+	Result *cbor.RawMessage `cbor:"result"`
+}
+
+// notifier は受け取られるまで通知を溜めておく。listen が通知の受け取りを待つと
+// rpc の応答も止まるため、チャンネルのバッファーではなく上限のないキューを使う。
+type notifier struct {
+	lock  sync.Mutex
+	queue []Notification
+	wake  chan struct{}
+	out   chan Notification
+}
+
+func (n *notifier) push(v Notification) {
+	n.lock.Lock()
+	n.queue = append(n.queue, v)
+	n.lock.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) run(closeChan chan bool) {
+	defer close(n.out)
+
+	for {
+		n.lock.Lock()
+		if len(n.queue) == 0 {
+			n.lock.Unlock()
+			select {
+			case <-closeChan:
+				return
+			case <-n.wake:
+			}
+			continue
+		}
+		v := n.queue[0]
+		n.queue = n.queue[1:]
+		n.lock.Unlock()
+
 		select {
-		case <-s.CloseChan:
+		case <-closeChan:
 			return
-		default:
-			_, data, err := s.ws.ReadMessage()
-			if err != nil {
-				switch {
-				case errors.Is(err, net.ErrClosed):
-					s.CloseErr = err
-				default:
-					s.CloseErr = err
-					<-s.CloseChan
-				}
+		case n.out <- v:
+		}
+	}
+}
+
+// Notifications は LIVE SELECT の通知を受け取るチャンネルを返す。
+// 通知はすべての LIVE SELECT のものが届き、接続を閉じると close される。
+// 再接続すると LIVE SELECT はやり直す必要がある。
+func (s *SDB) Notifications() <-chan Notification {
+	s.wsLock.Lock()
+	closeChan := s.CloseChan
+	s.wsLock.Unlock()
+
+	s.respLock.Lock()
+	defer s.respLock.Unlock()
+
+	if closeChan == nil {
+		out := make(chan Notification)
+		close(out)
+		return out
+	}
+
+	if s.notify == nil {
+		s.notify = &notifier{
+			wake: make(chan struct{}, 1),
+			out:  make(chan Notification),
+		}
+		go s.notify.run(closeChan)
+	}
+
+	return s.notify.out
+}
+
+func (s *SDB) dispatch(msg *cbor.RawMessage) {
+	if msg == nil {
+		return
+	}
+
+	var v Notification
+	if err := cbor.Unmarshal(*msg, &v); err != nil {
+		log.Println("decode notification failed:", err)
+		return
+	}
+
+	s.respLock.RLock()
+	n := s.notify
+	s.respLock.RUnlock()
+
+	if n != nil {
+		n.push(v)
+	}
+}
+
+// disconnect は読み込みに失敗した接続を破棄し、設定されていれば再接続を開始する。
+func (s *SDB) disconnect(ws *websocket.Conn, closeChan chan bool, err error) {
+	s.wsLock.Lock()
+	if s.ws != ws {
+		s.wsLock.Unlock()
+		return
+	}
+
+	s.ws = nil
+	s.CloseErr = err
+	reconnecting := s.reconnecting
+	if !reconnecting {
+		s.reconnecting = true
+		s.ready = make(chan bool)
+	}
+	s.wsLock.Unlock()
+
+	_ = ws.Close()
+	s.failChans()
+	if !reconnecting {
+		go s.reconnect(closeChan, err)
+	}
+}
+
+func (s *SDB) reconnect(closeChan chan bool, cause error) {
+	s.wsLock.Lock()
+	rc := s.Reconnect
+	onDisconnect := s.onDisconnect
+	s.wsLock.Unlock()
+
+	if onDisconnect != nil {
+		onDisconnect(cause)
+	}
+
+	if rc != nil {
+		delay := rc.Delay
+		if delay <= 0 {
+			delay = 100 * time.Millisecond
+		}
+		for n := 1; rc.MaxAttempts <= 0 || n <= rc.MaxAttempts; n++ {
+			select {
+			case <-closeChan:
 				return
+			case <-time.After(delay):
 			}
 
-			var resp rpcResponse
-			err = cbor.Unmarshal(data, &resp)
-			if err != nil {
-				log.Println("decode cbor failed:", err)
-				continue
+			err := s.redial(closeChan)
+			if err == nil {
+				s.wsLock.Lock()
+				onReconnect := s.onReconnect
+				s.wsLock.Unlock()
+
+				if onReconnect != nil {
+					onReconnect()
+				}
+
+				return
 			}
 
-			respChan, exists := s.getChan(resp.Id)
-			if exists {
-				respChan <- resp
+			log.Println("reconnect attempt", n, "failed:", err)
+			delay *= 2
+			if rc.MaxDelay > 0 && delay > rc.MaxDelay {
+				delay = rc.MaxDelay
 			}
 		}
 	}
+
+	// 再接続を諦めた場合、待機中の rpc には CloseErr を返す。
+	s.wsLock.Lock()
+	select {
+	case <-closeChan:
+		s.wsLock.Unlock()
+		return
+	default:
+	}
+	s.reconnecting = false
+	close(s.ready)
+	onGiveUp := s.onGiveUp
+	s.wsLock.Unlock()
+
+	if onGiveUp != nil {
+		onGiveUp(cause)
+	}
 }
 
-func (s *SDB) rpc(method string, params any) (*cbor.RawMessage, error) {
+// redial は接続をやり直し、記憶している認証情報と名前空間、データベースを復元する。
+func (s *SDB) redial(closeChan chan bool) error {
+	s.wsLock.Lock()
+	endpoint := s.endpoint
+	s.wsLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+
+	ws, err := dial(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+
+	s.wsLock.Lock()
 	select {
-	case <-s.CloseChan:
-		return nil, s.CloseErr
+	case <-closeChan:
+		s.wsLock.Unlock()
+		ws.Close()
+		return ErrClosed
 	default:
 	}
+	s.ws = ws
+	auth, use := s.auth, s.use
+	s.wsLock.Unlock()
+
+	go s.listen(ws, closeChan)
 
+	if auth != nil {
+		if _, err := s.call(ctx, "signin", [1]systemAuth{*auth}); err != nil {
+			s.drop(ws)
+			return err
+		}
+	}
+
+	if use != nil {
+		if _, err := s.call(ctx, "use", *use); err != nil {
+			s.drop(ws)
+			return err
+		}
+	}
+
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	if s.ws != ws {
+		return ErrDisconnected
+	}
+	s.CloseErr = nil
+	s.reconnecting = false
+	close(s.ready)
+
+	return nil
+}
+
+func (s *SDB) drop(ws *websocket.Conn) {
+	s.wsLock.Lock()
+	if s.ws == ws {
+		s.ws = nil
+	}
+	s.wsLock.Unlock()
+
+	ws.Close()
+}
+
+func (s *SDB) rpc(
+	ctx context.Context,
+	method string,
+	params any,
+) (*cbor.RawMessage, error) {
+	s.wsLock.Lock()
+	ready, closeChan := s.ready, s.CloseChan
+	s.wsLock.Unlock()
+
+	if closeChan == nil {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	select {
+	case <-closeChan:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, rpcDone(ctx, method)
+	case <-ready:
+	}
+
+	return s.call(ctx, method, params)
+}
+
+func rpcDone(ctx context.Context, method string) error {
+	return errors.Join(
+		ctx.Err(),
+		errors.New("'"+method+"' rpc is canceled or timed out"),
+	)
+}
+
+func (s *SDB) call(
+	ctx context.Context,
+	method string,
+	params any,
+) (*cbor.RawMessage, error) {
 	id := s.id.next()
 	respChan, err := s.setChan(id)
 	if err != nil {
@@ -253,12 +678,15 @@ func (s *SDB) rpc(method string, params any) (*cbor.RawMessage, error) {
 	}
 
 	select {
-	case <-time.After(5 * time.Second):
-		return nil, errors.New("'" + method + "' rpc timed out after 5 secconds")
+	case <-ctx.Done():
+		return nil, rpcDone(ctx, method)
 	case resp, open := <-respChan:
 		if !open {
-			return nil, errors.New(
-				"'" + method + "' rpc channel(" + strconv.Itoa(id) + ") is closed",
+			return nil, errors.Join(
+				ErrDisconnected,
+				errors.New(
+					"'"+method+"' rpc channel("+strconv.Itoa(id)+") is closed",
+				),
 			)
 		}
 		if resp.Error != nil {
@@ -276,6 +704,14 @@ func (s *SDB) write(req rpcRequest) error {
 	s.wsLock.Lock()
 	defer s.wsLock.Unlock()
 
+	if s.ws == nil {
+		if s.CloseErr != nil {
+			return errors.Join(ErrDisconnected, s.CloseErr)
+		}
+
+		return ErrDisconnected
+	}
+
 	v, err := cbor.Marshal(req)
 	if err != nil {
 		return err
@@ -288,13 +724,18 @@ func (s *SDB) setChan(id int) (chan rpcResponse, error) {
 	s.respLock.Lock()
 	defer s.respLock.Unlock()
 
+	if s.respChans == nil {
+		return nil, ErrClosed
+	}
+
 	if _, exists := s.respChans[id]; exists {
 		return nil, errors.New(
 			"rpc request id " + strconv.Itoa(id) + " is in use",
 		)
 	}
 
-	respChan := make(chan rpcResponse)
+	// 応答を待たずに戻った rpc があっても listen が止まらないようにする。
+	respChan := make(chan rpcResponse, 1)
 	s.respChans[id] = respChan
 
 	return respChan, nil
@@ -316,21 +757,79 @@ func (s *SDB) delChan(id int) {
 	delete(s.respChans, id)
 }
 
-func At[T any](q *[]queryResult, i int) (*T, error) {
-	if i < 0 || i > len(*q)-1 {
-		return nil, errors.New("out of range")
+// failChans は応答を待っているすべての rpc に切断を通知する。
+func (s *SDB) failChans() {
+	s.respLock.Lock()
+	defer s.respLock.Unlock()
+
+	for id, respChan := range s.respChans {
+		close(respChan)
+		delete(s.respChans, id)
 	}
+}
 
+// QueryError はクエリに含まれるステートメントの実行に失敗したことを表す。
+type QueryError struct {
+	Index   int
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+func statementError(q *[]queryResult, i int) error {
 	v := (*q)[i]
-	if v.Status != "OK" {
-		var r string
-		if err := cbor.Unmarshal(*v.Result, &r); err != nil {
-			return nil, err
+	if v.Status == "OK" {
+		return nil
+	}
+
+	var r string
+	if err := cbor.Unmarshal(*v.Result, &r); err != nil {
+		return err
+	}
+
+	return &QueryError{i, r}
+}
+
+// failedTransaction は、同じトランザクションの別のステートメントが失敗したために
+// 実行されなかったステートメントのエラーメッセージ。
+const failedTransaction = "The query was not executed due to a failed transaction"
+
+// Check はいずれかのステートメントが失敗していれば、その最初のエラーを返す。
+// トランザクションが失敗した場合は、実行されなかったステートメントではなく
+// 失敗の原因になったステートメントのエラーを返す。
+func Check(q *[]queryResult) error {
+	var first error
+	for i := range *q {
+		err := statementError(q, i)
+		if err == nil {
+			continue
+		}
+
+		var qe *QueryError
+		if !errors.As(err, &qe) || !strings.Contains(qe.Message, failedTransaction) {
+			return err
 		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
 
-		return nil, errors.New(r)
+func At[T any](q *[]queryResult, i int) (*T, error) {
+	if i < 0 || i > len(*q)-1 {
+		return nil, errors.New("out of range")
 	}
 
+	if err := statementError(q, i); err != nil {
+		return nil, err
+	}
+
+	v := (*q)[i]
+
 	var t T
 	if err := cbor.Unmarshal(*v.Result, &t); err != nil {
 		return nil, err
@@ -339,7 +838,21 @@ func At[T any](q *[]queryResult, i int) (*T, error) {
 	return &t, nil
 }
 
-const cborTagDatetime = 12
+const (
+	cborTagNone     = 6
+	cborTagRecordID = 8
+	cborTagDatetime = 12
+	cborTagDuration = 14
+	cborTagUUID     = 37
+)
+
+// RecordID は tb:id のレコード ID を返す。
+func RecordID(tb string, id any) *cbor.Tag {
+	return &cbor.Tag{
+		Number:  cborTagRecordID,
+		Content: []any{tb, id},
+	}
+}
 
 func Datetime(t *time.Time) *cbor.Tag {
 	if t == nil {
@@ -352,6 +865,100 @@ func Datetime(t *time.Time) *cbor.Tag {
 	}
 }
 
+// Time は SurrealDB の datetime を読み込む。NONE と NULL はゼロ値になる。
+type Time struct {
+	time.Time
+}
+
+func (t *Time) UnmarshalCBOR(b []byte) error {
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(b, &tag); err != nil {
+		var v any
+		if err := cbor.Unmarshal(b, &v); err == nil && v == nil {
+			t.Time = time.Time{}
+			return nil
+		}
+		return err
+	}
+
+	switch tag.Number {
+	case cborTagNone:
+		t.Time = time.Time{}
+		return nil
+	case cborTagDatetime:
+		var v []int64
+		if err := cbor.Unmarshal(tag.Content, &v); err != nil {
+			return err
+		}
+		var sec, nsec int64
+		if len(v) > 0 {
+			sec = v[0]
+		}
+		if len(v) > 1 {
+			nsec = v[1]
+		}
+		t.Time = time.Unix(sec, nsec)
+		return nil
+	default:
+		return errors.New("unexpected cbor tag " + strconv.FormatUint(tag.Number, 10) + " for datetime")
+	}
+}
+
+// UUID は SurrealDB の uuid。LIVE SELECT の ID に使われる。
+type UUID [16]byte
+
+func (u UUID) MarshalCBOR() ([]byte, error) {
+	return cbor.Marshal(cbor.Tag{
+		Number:  cborTagUUID,
+		Content: u[:],
+	})
+}
+
+func (u *UUID) UnmarshalCBOR(b []byte) error {
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(b, &tag); err != nil {
+		return err
+	}
+	if tag.Number != cborTagUUID {
+		return errors.New("unexpected cbor tag " + strconv.FormatUint(tag.Number, 10) + " for uuid")
+	}
+
+	var v []byte
+	if err := cbor.Unmarshal(tag.Content, &v); err != nil {
+		return err
+	}
+	if len(v) != len(u) {
+		return errors.New("invalid uuid length " + strconv.Itoa(len(v)))
+	}
+	copy(u[:], v)
+
+	return nil
+}
+
+func (u UUID) String() string {
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 36)
+	for i, c := range u {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			b = append(b, '-')
+		}
+		b = append(b, hex[c>>4], hex[c&0xf])
+	}
+
+	return string(b)
+}
+
+func Duration(d *time.Duration) *cbor.Tag {
+	if d == nil {
+		return nil
+	}
+
+	return &cbor.Tag{
+		Number:  cborTagDuration,
+		Content: [2]int64{int64(*d / time.Second), int64(*d % time.Second)},
+	}
+}
+
 const (
 	bracketL    = "⟨"
 	bracketR    = "⟩"
@@ -423,6 +1030,25 @@ func QuoteRid(rid string) string {
 	return escapeFullNumeric(rid, bracketL, bracketR, bracketEsc)
 }
 
+// SanitizeIdent は英数字と _ 以外の文字を _ に置き換え、QuoteIdent で
+// エスケープする必要のない識別子にする。
+func SanitizeIdent(s string) string {
+	b := []byte{}
+	for _, r := range s {
+		if r < 0x80 && (isAsciiAlphaNumeric(int(r)) || r == underscore) {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, underscore)
+		}
+	}
+
+	if len(b) == 0 || isAsciiDigit(int(b[0])) {
+		b = append([]byte{underscore}, b...)
+	}
+
+	return string(b)
+}
+
 func QuoteIdent(ident string) string {
 	if ident == "" {
 		return backtick + backtick
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -24,26 +23,76 @@ import (
 
 const envPrefix = "SURREALLOG_"
 
+// subcommands は surreallog 自身のサブコマンド。
+var subcommands = map[string]func(args []string) int{
+	"migrate": migrateMain,
+	"prune":   pruneMain,
+	"tail":    tailMain,
+}
+
 func getCommand() (string, []string, error) {
-	if len(os.Args) < 2 {
-		msg := "usage: surreallog <cmd> [args...]"
+	args := os.Args[1:]
+	// サブコマンドと同じ名前のコマンドは -- の後に指定する。
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if len(args) < 1 {
+		msg := "usage: surreallog [--] <cmd> [args...]\n" +
+			"       surreallog migrate <ns> <db>\n" +
+			"       surreallog prune <ns> <db> [--dry-run]\n" +
+			"       surreallog tail <ns> <db> [run]"
 		return "", make([]string, 0), errors.New(msg)
 	}
 
-	return os.Args[1], os.Args[2:], nil
+	return args[0], args[1:], nil
 }
 
 type options struct {
-	endpoint string
-	user     string
-	pass     string
-	ns       string
-	db       string
-	cd       time.Duration
-	mbs      uint64
+	endpoint   string
+	user       string
+	pass       string
+	ns         string
+	db         string
+	runID      string
+	shared     bool
+	migrate    bool
+	search     bool
+	tokenizers string
+	filters    string
+	cd         time.Duration
+	mbs        uint64
+	gp         time.Duration
+	drain      time.Duration
+	pgrp       bool
+	pty        bool
+	ptyMerge   bool
+	ptyCols    uint16
+	ptyRows    uint16
+	ansi       string
+	upsert     bool
+	labels     map[string]string
+	platforms  map[string]map[string]string
+	tee        bool
+	teeMask    bool
+	spoolDir   string
+	rc         *sdb.Reconnect
+	timeout    time.Duration
+	mls        uint64
+	mlsTrunc   bool
+	plt        time.Duration
+	retryMax   int
+	retryDelay time.Duration
+	fallback   string
+	retention  time.Duration
+	stale      time.Duration
+	maxRuns    int
+	maxLines   int64
 }
 
-func getOptions() (*options, error) {
+// getConnOptions は SurrealDB への接続に使うオプションだけを読む。
+// 実行を記録しないサブコマンドは、名前のテンプレートを評価せずにこれを使う。
+func getConnOptions() (*options, error) {
 	endpoint, err := url.Parse(os.Getenv(envPrefix + "ENDPOINT"))
 	if err != nil {
 		return nil, err
@@ -59,6 +108,116 @@ func getOptions() (*options, error) {
 		return nil, errors.New("env." + envPrefix + "PASS not found")
 	}
 
+	var timeout time.Duration
+	if env, found := os.LookupEnv(envPrefix + "TIMEOUT"); found {
+		timeout, err = time.ParseDuration(env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		timeout = 5 * time.Second
+	}
+
+	reconnect := true
+	if env, found := os.LookupEnv(envPrefix + "RECONNECT"); found {
+		reconnect, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rc *sdb.Reconnect
+	if reconnect {
+		rc = &sdb.Reconnect{
+			Delay:    500 * time.Millisecond,
+			MaxDelay: 30 * time.Second,
+		}
+
+		if env, found := os.LookupEnv(envPrefix + "RECONNECT_DELAY"); found {
+			rc.Delay, err = time.ParseDuration(env)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if env, found := os.LookupEnv(envPrefix + "RECONNECT_MAX_DELAY"); found {
+			rc.MaxDelay, err = time.ParseDuration(env)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if env, found := os.LookupEnv(envPrefix + "RECONNECT_MAX_ATTEMPTS"); found {
+			rc.MaxAttempts, err = strconv.Atoi(env)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	opt := &options{
+		endpoint: endpoint.String(),
+		user:     user,
+		pass:     pass,
+		rc:       rc,
+		timeout:  timeout,
+	}
+
+	return opt, nil
+}
+
+// getPruneOptions は実行を削除する条件を opt に読む。
+func getPruneOptions(opt *options) error {
+	var err error
+	if env, found := os.LookupEnv(envPrefix + "RETENTION"); found {
+		opt.retention, err = parseRetention(env)
+		if err != nil {
+			return err
+		}
+		if opt.retention < 0 {
+			return errors.New("env." + envPrefix + "RETENTION must not be negative")
+		}
+	}
+
+	if env, found := os.LookupEnv(envPrefix + "STALE_AFTER"); found {
+		opt.stale, err = parseRetention(env)
+		if err != nil {
+			return err
+		}
+		if opt.stale < 0 {
+			return errors.New("env." + envPrefix + "STALE_AFTER must not be negative")
+		}
+	}
+
+	if env, found := os.LookupEnv(envPrefix + "MAX_RUNS"); found {
+		opt.maxRuns, err = strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+		if opt.maxRuns < 0 {
+			return errors.New("env." + envPrefix + "MAX_RUNS must not be negative")
+		}
+	}
+
+	if env, found := os.LookupEnv(envPrefix + "MAX_LINES"); found {
+		opt.maxLines, err = strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+		if opt.maxLines < 0 {
+			return errors.New("env." + envPrefix + "MAX_LINES must not be negative")
+		}
+	}
+
+	return nil
+}
+
+func getOptions(command string) (*options, error) {
+	conn, err := getConnOptions()
+	if err != nil {
+		return nil, err
+	}
+
 	ns := os.Getenv(envPrefix + "NAMESPACE")
 	if ns == "" {
 		return nil, errors.New("env." + envPrefix + "NAMESPACE not found")
@@ -69,14 +228,54 @@ func getOptions() (*options, error) {
 		name = "{{ hostname }}"
 	}
 
-	hostnameRe := regexp.MustCompile(`{{\s*hostname\s*}}`)
-	if hostnameRe.MatchString(name) {
-		hostname, err := os.Hostname()
+	// 名前の誤りは SurrealDB に接続する前に報告する。
+	platforms := detectPlatforms()
+	funcs := templateFuncs(command, platforms)
+	ns, err = renderTemplate(envPrefix+"NAMESPACE", ns, funcs)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err = renderTemplate(envPrefix+"NAME", name, funcs)
+	if err != nil {
+		return nil, err
+	}
+
+	runIDEnv := os.Getenv(envPrefix + "RUN_ID")
+	strategy := os.Getenv(envPrefix + "RUN_ID_STRATEGY")
+	if strategy == "" {
+		strategy = "counter"
+		if runIDEnv != "" {
+			strategy = "env"
+		}
+	}
+
+	// counter の場合は SurrealDB に接続してから決める。
+	var runID string
+	switch strategy {
+	case "counter", "ulid", "uuidv7":
+		if runIDEnv != "" {
+			return nil, errors.New("env." + envPrefix + "RUN_ID requires env." + envPrefix + "RUN_ID_STRATEGY=env")
+		}
+		switch strategy {
+		case "ulid":
+			runID = newULID()
+		case "uuidv7":
+			runID = newUUIDv7()
+		}
+	case "env":
+		if runIDEnv == "" {
+			return nil, errors.New("env." + envPrefix + "RUN_ID not found")
+		}
+		runID, err = renderTemplate(envPrefix+"RUN_ID", runIDEnv, funcs)
 		if err != nil {
 			return nil, err
 		}
-
-		name = hostnameRe.ReplaceAllString(name, hostname)
+		if reservedTables[runID] {
+			return nil, errors.New("env." + envPrefix + "RUN_ID must not be " + runID + ", which is used by surreallog")
+		}
+	default:
+		return nil, errors.New("env." + envPrefix + "RUN_ID_STRATEGY must be counter, ulid, uuidv7 or env")
 	}
 
 	var cd time.Duration
@@ -99,14 +298,247 @@ func getOptions() (*options, error) {
 		mbs = 1048576 // 2 MiB
 	}
 
+	var mls uint64
+	if env, found := os.LookupEnv(envPrefix + "MAX_LINE_SIZE"); found {
+		mls, err = humanize.ParseBytes(env)
+		if err != nil {
+			return nil, err
+		}
+		if mls == 0 {
+			return nil, errors.New("env." + envPrefix + "MAX_LINE_SIZE must be positive")
+		}
+	} else {
+		mls = 65536 // 64 KiB
+	}
+
+	var plt time.Duration
+	if env, found := os.LookupEnv(envPrefix + "PARTIAL_LINE_TIMEOUT"); found {
+		plt, err = time.ParseDuration(env)
+		if err != nil {
+			return nil, err
+		}
+		if plt < 0 {
+			return nil, errors.New("env." + envPrefix + "PARTIAL_LINE_TIMEOUT must not be negative")
+		}
+	}
+
+	var mlsTrunc bool
+	switch env := os.Getenv(envPrefix + "LONG_LINES"); env {
+	case "", "split":
+	case "truncate":
+		mlsTrunc = true
+	default:
+		return nil, errors.New("env." + envPrefix + "LONG_LINES must be split or truncate")
+	}
+
+	var gp time.Duration
+	if env, found := os.LookupEnv(envPrefix + "GRACE_PERIOD"); found {
+		gp, err = time.ParseDuration(env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		gp = 10 * time.Second
+	}
+
+	var drain time.Duration
+	if env, found := os.LookupEnv(envPrefix + "DRAIN_TIMEOUT"); found {
+		drain, err = time.ParseDuration(env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		drain = 5 * time.Second
+	}
+
+	var pgrp bool
+	if env, found := os.LookupEnv(envPrefix + "SIGNAL_GROUP"); found {
+		pgrp, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pty bool
+	if env, found := os.LookupEnv(envPrefix + "PTY"); found {
+		pty, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ptyMerge := true
+	switch env := os.Getenv(envPrefix + "PTY_STDERR"); env {
+	case "", "merge":
+	case "pipe":
+		ptyMerge = false
+	default:
+		return nil, errors.New("env." + envPrefix + "PTY_STDERR must be merge or pipe")
+	}
+
+	var ptyCols, ptyRows uint16 = 80, 24
+	if env, found := os.LookupEnv(envPrefix + "PTY_SIZE"); found {
+		cols, rows, ok := strings.Cut(env, "x")
+		c, err1 := strconv.ParseUint(cols, 10, 16)
+		r, err2 := strconv.ParseUint(rows, 10, 16)
+		if !ok || err1 != nil || err2 != nil || c == 0 || r == 0 {
+			return nil, errors.New("env." + envPrefix + "PTY_SIZE must be <columns>x<rows>")
+		}
+		ptyCols, ptyRows = uint16(c), uint16(r)
+	}
+
+	ansi := os.Getenv(envPrefix + "ANSI")
+	switch ansi {
+	case "":
+		ansi = "keep"
+	case "keep", "strip", "raw", "styles":
+	default:
+		return nil, errors.New("env." + envPrefix + "ANSI must be keep, strip, raw or styles")
+	}
+
+	upsert := false
+	switch env := os.Getenv(envPrefix + "INSERT_MODE"); env {
+	case "", "ignore":
+	case "upsert":
+		upsert = true
+	default:
+		return nil, errors.New("env." + envPrefix + "INSERT_MODE must be ignore or upsert")
+	}
+
+	var labels map[string]string
+	if env := os.Getenv(envPrefix + "LABELS"); env != "" {
+		labels = map[string]string{}
+		for _, kv := range strings.Split(env, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			k = strings.TrimSpace(k)
+			if !ok || k == "" {
+				return nil, errors.New("env." + envPrefix + "LABELS must be key=value,...")
+			}
+			labels[k] = strings.TrimSpace(v)
+		}
+	}
+
+	shared := false
+	switch env := os.Getenv(envPrefix + "LAYOUT"); env {
+	case "", "table":
+	case "shared":
+		shared = true
+	default:
+		return nil, errors.New("env." + envPrefix + "LAYOUT must be table or shared")
+	}
+
+	migrate := true
+	if env, found := os.LookupEnv(envPrefix + "MIGRATE"); found {
+		migrate, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var search bool
+	if env, found := os.LookupEnv(envPrefix + "SEARCH"); found {
+		search, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	searchTokenizers := "blank,class,camel,punct"
+	if env, found := os.LookupEnv(envPrefix + "SEARCH_TOKENIZERS"); found {
+		searchTokenizers, err = parseSearchList(envPrefix+"SEARCH_TOKENIZERS", env, tokenizerRe)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	searchFilters := "lowercase,ascii"
+	if env, found := os.LookupEnv(envPrefix + "SEARCH_FILTERS"); found {
+		searchFilters, err = parseSearchList(envPrefix+"SEARCH_FILTERS", env, filterRe)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tee := true
+	if env, found := os.LookupEnv(envPrefix + "TEE"); found {
+		tee, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	teeMask := true
+	if env, found := os.LookupEnv(envPrefix + "TEE_MASK"); found {
+		teeMask, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spoolDir := os.Getenv(envPrefix + "SPOOL_DIR")
+
+	retryMax := 3
+	if env, found := os.LookupEnv(envPrefix + "RETRY_MAX"); found {
+		retryMax, err = strconv.Atoi(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var retryDelay time.Duration
+	if env, found := os.LookupEnv(envPrefix + "RETRY_DELAY"); found {
+		retryDelay, err = time.ParseDuration(env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		retryDelay = 500 * time.Millisecond
+	}
+
+	fallback := os.Getenv(envPrefix + "FALLBACK_FILE")
+	if fallback == "" {
+		fallback = filepath.Join(os.TempDir(), "surreallog-dropped.cbor")
+	}
+
 	opt := &options{
-		endpoint: endpoint.String(),
-		user:     user,
-		pass:     pass,
-		ns:       ns,
-		db:       name,
-		cd:       cd,
-		mbs:      mbs,
+		endpoint:   conn.endpoint,
+		user:       conn.user,
+		pass:       conn.pass,
+		ns:         ns,
+		db:         name,
+		runID:      runID,
+		shared:     shared,
+		migrate:    migrate,
+		search:     search,
+		tokenizers: searchTokenizers,
+		filters:    searchFilters,
+		cd:         cd,
+		mbs:        mbs,
+		gp:         gp,
+		drain:      drain,
+		pgrp:       pgrp,
+		pty:        pty,
+		ptyMerge:   ptyMerge,
+		ptyCols:    ptyCols,
+		ptyRows:    ptyRows,
+		ansi:       ansi,
+		upsert:     upsert,
+		labels:     labels,
+		platforms:  platforms,
+		tee:        tee,
+		teeMask:    teeMask,
+		spoolDir:   spoolDir,
+		rc:         conn.rc,
+		timeout:    conn.timeout,
+		mls:        mls,
+		mlsTrunc:   mlsTrunc,
+		plt:        plt,
+		retryMax:   retryMax,
+		retryDelay: retryDelay,
+		fallback:   fallback,
+	}
+	if err := getPruneOptions(opt); err != nil {
+		return nil, err
 	}
 
 	return opt, nil
@@ -120,95 +552,234 @@ USE NS %s;                         -- 1
 DEFINE DATABASE IF NOT EXISTS %s; -- 2
 USE DB %s;                        -- 3
 
-DEFINE TABLE IF NOT EXISTS counter SCHEMAFULL;        -- 4
-DEFINE FIELD IF NOT EXISTS value ON counter TYPE int; -- 5
-
-UPSERT ONLY counter:tb SET value += 1 RETURN VALUE value; -- 6
-
-DEFINE TABLE IF NOT EXISTS catalog SCHEMAFULL;                           -- 7
-DEFINE FIELD IF NOT EXISTS startedAt   ON catalog TYPE option<datetime>; -- 8
-DEFINE FIELD IF NOT EXISTS completedAt ON catalog TYPE option<datetime>; -- 9
-DEFINE FIELD IF NOT EXISTS exitCode    ON catalog TYPE option<int>;      -- 10
+DEFINE TABLE IF NOT EXISTS meta SCHEMAFULL;                        -- 4
+DEFINE FIELD IF NOT EXISTS version   ON meta TYPE int;              -- 5
+DEFINE FIELD IF NOT EXISTS updatedAt ON meta TYPE option<datetime>; -- 6
 `
 
+	// 実行の ID と同じ名前のテーブルが既にあれば、catalog にも残さない。
 	DEFINE_TABLE_QUERY_TEMPLATE = `
-CREATE catalog:%s RETURN NONE; -- 0
+BEGIN TRANSACTION;
+CREATE catalog:%s SET layout = 'table' RETURN NONE; -- 0
 
 DEFINE TABLE %s SCHEMAFULL;                           -- 1
 DEFINE FIELD kind ON %s TYPE -1 | 1 | 2;              -- 2
 DEFINE FIELD time ON %s TYPE datetime;                -- 3
 DEFINE FIELD text ON %s TYPE string;                  -- 4
 DEFINE FIELD data ON %s TYPE option<string>;          -- 5
-DEFINE FIELD opts ON %s FLEXIBLE TYPE option<object>; -- 6`
+DEFINE FIELD opts ON %s FLEXIBLE TYPE option<object>; -- 6
+DEFINE FIELD seq ON %s TYPE int;                      -- 7
+DEFINE FIELD lineNo ON %s TYPE option<int>;           -- 8
+COMMIT TRANSACTION;`
+
+	CREATE_RUN_QUERY_TEMPLATE = `
+CREATE catalog:%s SET layout = 'shared' RETURN NONE; -- 0`
+
+	COUNTER_QUERY_TEMPLATE = `
+UPSERT ONLY counter:tb SET value += 1 RETURN VALUE value; -- 0`
 
 	START_QUERY_TEMPLATE = `
-UPDATE catalog:%s SET startedAt = time::now() RETURN NONE; -- 0`
+UPDATE catalog:%s SET startedAt = time::now(), hostname = $hostname, cwd = $cwd, user = $user, version = $version, labels = $labels, platform = $platform RETURN NONE; -- 0`
 
 	COMPLETE_QUERY_TEMPLATE = `
-UPDATE catalog:%s SET completedAt = time::now(), exitCode = $code RETURN NONE; -- 0`
+UPDATE catalog:%s SET completedAt = time::now(), exitCode = $code, signal = $signal, outputs = $outputs, state = $state, env = $env, summary = $summary, command = $command, args = $args, pid = $pid, wallTime = $wallTime, userTime = $userTime, systemTime = $systemTime, maxRss = $maxRss RETURN NONE; -- 0`
 
 	INSERT_LINES_QUERY_TEMPLATE = `
-INSERT INTO %s $data RETURN NONE; -- 0`
+INSERT IGNORE INTO %s $data RETURN NONE; -- 0`
+
+	UPSERT_LINES_QUERY_TEMPLATE = `
+INSERT INTO %s $data ON DUPLICATE KEY UPDATE
+    seq = $input.seq, lineNo = $input.lineNo, kind = $input.kind, time = $input.time,
+    text = $input.text, data = $input.data, opts = $input.opts
+RETURN NONE; -- 0`
 )
 
 type completeQueryVars struct {
-	Code int `cbor:"code"`
+	Code    int               `cbor:"code"`
+	Signal  string            `cbor:"signal,omitempty"`
+	Outputs map[string]string `cbor:"outputs,omitempty"`
+	State   map[string]string `cbor:"state,omitempty"`
+	Env     map[string]string `cbor:"env,omitempty"`
+	Summary string            `cbor:"summary,omitempty"`
+
+	Command    string    `cbor:"command,omitempty"`
+	Args       []string  `cbor:"args"`
+	Pid        int       `cbor:"pid,omitempty"`
+	WallTime   *cbor.Tag `cbor:"wallTime,omitempty"`
+	UserTime   *cbor.Tag `cbor:"userTime,omitempty"`
+	SystemTime *cbor.Tag `cbor:"systemTime,omitempty"`
+	MaxRss     int64     `cbor:"maxRss,omitempty"`
+}
+
+// insertQuery は行を挿入するクエリを返す。行の ID は実行内の通し番号から決まるため、
+// 同じバッチを再送しても行は重複しない。
+func insertQuery(tb string, opt *options) string {
+	if opt.upsert {
+		return fmt.Sprintf(UPSERT_LINES_QUERY_TEMPLATE, tb)
+	}
+
+	return fmt.Sprintf(INSERT_LINES_QUERY_TEMPLATE, tb)
 }
 
 type insertLinesQueryVars struct {
 	Data []*cborLine `cbor:"data"`
 }
 
+// table は実行の行の挿入先。shared レイアウトでは全ての実行で line テーブルを共有し、
+// 行の run に実行の catalog のレコードを持たせる。
 type table struct {
 	rid   string
 	ident string
+	run   *cbor.Tag
 }
 
-func initSurrealDB(db *sdb.SDB, opt *options) (*table, error) {
-	if err := db.Signin(opt.user, opt.pass); err != nil {
-		return nil, err
+// prepareSurrealDB はサインインして名前空間とデータベースを用意し、スキーマを確認する。
+func prepareSurrealDB(ctx context.Context, db *sdb.SDB, opt *options) error {
+	if err := db.SigninContext(ctx, opt.user, opt.pass); err != nil {
+		return err
 	}
 
 	nsIdent := sdb.QuoteIdent(opt.ns)
 	dbIdent := sdb.QuoteIdent(opt.db)
 	q := fmt.Sprintf(SETUP_QUERY_TEMPLATE, nsIdent, nsIdent, dbIdent, dbIdent)
-	r, err := db.Query(q, struct{}{})
+	r, err := db.QueryContext(ctx, q, struct{}{})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	i, err := sdb.At[int](r, 6)
-	if err != nil {
-		return nil, err
+	if err := sdb.Check(r); err != nil {
+		return err
 	}
 
-	if err := db.Use(opt.ns, opt.db); err != nil {
-		return nil, err
+	if err := db.UseContext(ctx, opt.ns, opt.db); err != nil {
+		return err
+	}
+
+	_, err = ensureSchema(ctx, db, opt.migrate)
+	return err
+}
+
+// initSurrealDB は実行を catalog に登録し、行の挿入先を用意する。
+func initSurrealDB(ctx context.Context, db *sdb.SDB, opt *options) (*table, error) {
+	ti := opt.runID
+	if ti == "" {
+		r, err := db.QueryContext(ctx, COUNTER_QUERY_TEMPLATE, struct{}{})
+		if err != nil {
+			return nil, err
+		}
+
+		i, err := sdb.At[int](r, 0)
+		if err != nil {
+			return nil, err
+		}
+		ti = strconv.Itoa(*i)
+	}
+	slog.Debug("run " + ti)
+
+	if opt.shared {
+		tb := &table{
+			rid:   sdb.QuoteRid(ti),
+			ident: "line",
+			run:   sdb.RecordID("catalog", ti),
+		}
+		q := fmt.Sprintf(CREATE_RUN_QUERY_TEMPLATE, tb.rid)
+		r, err := db.QueryContext(ctx, q, struct{}{})
+		if err != nil {
+			return nil, err
+		}
+		if err := sdb.Check(r); err != nil {
+			return nil, errors.New("cannot create run " + ti + ": " + err.Error())
+		}
+
+		if opt.search {
+			if err := defineSearchIndexes(ctx, db, tb.ident, opt); err != nil {
+				return nil, err
+			}
+		}
+
+		return tb, nil
 	}
 
-	ti := strconv.Itoa(*i)
 	tb := &table{
 		rid:   sdb.QuoteRid(ti),
 		ident: sdb.QuoteIdent(ti),
 	}
-	q = fmt.Sprintf(
+	q := fmt.Sprintf(
 		DEFINE_TABLE_QUERY_TEMPLATE,
 		tb.rid, tb.ident, tb.ident, tb.ident, tb.ident, tb.ident, tb.ident,
+		tb.ident, tb.ident,
 	)
-	if _, err := db.Query(q, struct{}{}); err != nil {
+	r, err := db.QueryContext(ctx, q, struct{}{})
+	if err != nil {
 		return nil, err
 	}
+	// 既にある実行に書き込むと、INSERT IGNORE で行が失われる。
+	if err := sdb.Check(r); err != nil {
+		return nil, errors.New("cannot create run " + ti + ": " + err.Error())
+	}
+
+	if opt.search {
+		if err := defineSearchIndexes(ctx, db, tb.ident, opt); err != nil {
+			return nil, err
+		}
+	}
 
 	return tb, nil
 }
 
-func getSurreal(opt *options) (*sdb.SDB, *table, error) {
-	db := &sdb.SDB{}
-	if err := db.Connect(opt.endpoint); err != nil {
+func connectSurreal(ctx context.Context, opt *options) (*sdb.SDB, error) {
+	db := &sdb.SDB{
+		Reconnect: opt.rc,
+		Timeout:   opt.timeout,
+	}
+	if err := db.ConnectContext(ctx, opt.endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := prepareSurrealDB(ctx, db, opt); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// useSurreal は名前空間やデータベースを定義したりマイグレーションしたりせずに、
+// opt.ns と opt.db を使うように接続する。読むだけのサブコマンドが使う。
+func useSurreal(ctx context.Context, opt *options) (*sdb.SDB, error) {
+	db := &sdb.SDB{
+		Reconnect: opt.rc,
+		Timeout:   opt.timeout,
+	}
+	if err := db.ConnectContext(ctx, opt.endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := db.SigninContext(ctx, opt.user, opt.pass); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.UseContext(ctx, opt.ns, opt.db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func getSurreal(ctx context.Context, opt *options) (*sdb.SDB, *table, error) {
+	db, err := connectSurreal(ctx, opt)
+	if err != nil {
 		return nil, nil, err
 	}
 
-	tb, err := initSurrealDB(db, opt)
+	if opt.pruning() {
+		if err := prune(ctx, db, opt, false, func(msg string) { slog.Info(msg) }); err != nil {
+			slog.Warn("failed to prune runs: " + err.Error())
+		}
+	}
+
+	tb, err := initSurrealDB(ctx, db, opt)
 	if err != nil {
 		db.Close()
 		return nil, nil, err
@@ -230,12 +801,14 @@ func getCmdEnv() []string {
 }
 
 type line struct {
-	kind int
-	time *time.Time
-	size int
-	text string
-	data string
-	opts map[string]any
+	seq    uint64
+	lineNo int
+	kind   int
+	time   *time.Time
+	size   int
+	text   string
+	data   string
+	opts   map[string]any
 }
 
 func newLine(fd1 bool, size int, text string) *line {
@@ -274,39 +847,104 @@ func newCommand(size int, c *ghc.GHC) (*line, error) {
 }
 
 type cborLine struct {
-	Kind int            `cbor:"kind"`
-	Time *cbor.Tag      `cbor:"time"`
-	Text string         `cbor:"text"`
-	Data string         `cbor:"data,omitempty"`
-	Opts map[string]any `cbor:"opts,omitempty"`
+	ID     []any          `cbor:"id,omitempty"`
+	Run    *cbor.Tag      `cbor:"run,omitempty"`
+	Seq    uint64         `cbor:"seq"`
+	LineNo int            `cbor:"lineNo,omitempty"`
+	Kind   int            `cbor:"kind"`
+	Time   *cbor.Tag      `cbor:"time"`
+	Text   string         `cbor:"text"`
+	Data   string         `cbor:"data,omitempty"`
+	Opts   map[string]any `cbor:"opts,omitempty"`
 }
 
 func toCborLine(l *line) *cborLine {
 	return &cborLine{
-		Kind: l.kind,
-		Time: sdb.Datetime(l.time),
-		Text: l.text,
-		Data: l.data,
-		Opts: l.opts,
+		ID:     []any{l.seq},
+		Seq:    l.seq,
+		LineNo: l.lineNo,
+		Kind:   l.kind,
+		Time:   sdb.Datetime(l.time),
+		Text:   l.text,
+		Data:   l.data,
+		Opts:   l.opts,
 	}
 }
 
+// sendQueueLength は送信を待つバッチの上限。SurrealDB が遅いか切断している間に
+// これを超えたバッチは、子プロセスの出力の読み込みを止めないようにフォールバックファイルに書き出す。
+const sendQueueLength = 16
+
+var errQueueFull = errors.New("too many batches waiting to be sent")
+
+// sender は行をバッチにまとめ、専用の goroutine で送信する。
+// 送信や再試行は s.mu の外で行うため、write が SurrealDB を待つことはない。
 type sender struct {
+	ctx     context.Context
 	db      *sdb.SDB
 	q       string
+	tb      *table
 	buf     []*cborLine
 	bufSize uint64
 	mu      sync.Mutex
 	timer   *time.Timer
 	opt     *options
+	spool   *spool
+	queue   chan []*cborLine
+	kick    chan struct{} // スプールに新しいセグメントがある
+	resumed chan struct{} // 再接続したか、再接続を諦めた
+	closing chan struct{}
+	done    chan struct{}
+	lost    atomic.Bool // 再接続を諦めた
+}
+
+func newSender(
+	ctx context.Context,
+	db *sdb.SDB,
+	tb *table,
+	opt *options,
+	sp *spool,
+) *sender {
+	s := &sender{
+		ctx:     ctx,
+		db:      db,
+		q:       insertQuery(tb.ident, opt),
+		tb:      tb,
+		buf:     []*cborLine{},
+		opt:     opt,
+		spool:   sp,
+		queue:   make(chan []*cborLine, sendQueueLength),
+		kick:    make(chan struct{}, 1),
+		resumed: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// 切断中は送信を止め、バッチを送信待ちかスプールに溜めておく。
+	db.OnDisconnect(func(err error) {
+		slog.Warn("disconnected: " + err.Error())
+	})
+	db.OnReconnect(func() {
+		slog.Info("reconnected")
+		notify(s.resumed)
+	})
+	// 再接続を諦めた後は、溜めたバッチと以降のバッチをフォールバックファイルに書き出す。
+	db.OnGiveUp(func(err error) {
+		slog.Error("gave up reconnecting: " + err.Error())
+		s.lost.Store(true)
+		notify(s.resumed)
+	})
+
+	go s.run()
+
+	return s
 }
 
-func newSender(db *sdb.SDB, tb *table, opt *options) *sender {
-	return &sender{
-		db:  db,
-		q:   fmt.Sprintf(INSERT_LINES_QUERY_TEMPLATE, tb.ident),
-		buf: []*cborLine{},
-		opt: opt,
+// notify は ch を待っている goroutine を起こす。既に通知済みであれば何もしない。
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
 }
 
@@ -318,7 +956,12 @@ func (s *sender) write(l *line) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.buf = append(s.buf, toCborLine(l))
+	cl := toCborLine(l)
+	if s.tb.run != nil {
+		cl.Run = s.tb.run
+		cl.ID = []any{s.tb.run, l.seq}
+	}
+	s.buf = append(s.buf, cl)
 	s.bufSize += uint64(l.size)
 
 	if s.timer != nil {
@@ -326,177 +969,222 @@ func (s *sender) write(l *line) {
 	}
 	s.timer = time.AfterFunc(s.opt.cd, func() {
 		s.mu.Lock()
-		defer s.mu.Unlock()
-		s.flush()
+		batch := s.take()
+		s.mu.Unlock()
+
+		s.enqueue(batch, false)
 	})
 
 	if s.bufSize >= s.opt.mbs { // 1 MiB
-		s.flush()
+		s.enqueue(s.take(), false)
 	}
 }
 
-func (s *sender) flush() {
-	l := len(s.buf)
-	if l == 0 {
-		return
-	}
-
-	if _, err := s.db.Query(s.q, &insertLinesQueryVars{s.buf}); err != nil {
-		slog.Warn(err.Error())
-	} else {
-		slog.Debug("insert " + strconv.Itoa(l) + " line(s)")
-	}
-
-	s.buf = s.buf[:0]
-	s.bufSize = 0
-
+// take はバッファの行を取り出す。s.mu を持って呼ぶ。
+func (s *sender) take() []*cborLine {
 	if s.timer != nil {
 		s.timer.Stop()
 		s.timer = nil
 	}
+
+	batch := s.buf
+	s.buf = []*cborLine{}
+	s.bufSize = 0
+
+	return batch
 }
 
-func splitFunc(data []byte, atEOF bool) (int, []byte, error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
+// enqueue はバッチを送信用の goroutine に渡す。スプールがあればスプールに書き出す。
+// wait が false であれば送信を待たず、送信待ちが一杯ならフォールバックファイルに書き出す。
+func (s *sender) enqueue(batch []*cborLine, wait bool) {
+	if len(batch) == 0 {
+		return
 	}
 
-	for i := 0; i < len(data); i++ {
-		switch data[i] {
-		case '\n':
-			if i > 0 && data[i-1] == '\r' {
-				return i + 1, data[:i-1], nil // CRLF
-			}
+	if s.spool != nil {
+		if err := s.spool.write(s.tb.ident, batch); err != nil {
+			slog.Warn("spool: " + err.Error())
+		} else {
+			notify(s.kick)
+			return
+		}
+	}
 
-			return i + 1, data[:i], nil // LF
+	if wait {
+		s.queue <- batch
+		return
+	}
+
+	select {
+	case s.queue <- batch:
+	default:
+		s.dropLines(batch, errQueueFull)
+	}
+}
+
+// run は送信待ちのバッチとスプールのセグメントを順に送信する。
+func (s *sender) run() {
+	defer close(s.done)
 
-		case '\r':
-			if i == len(data)-1 || data[i+1] != '\n' {
-				return i + 1, data[:i], nil // CR
+	s.replay()
+	for {
+		select {
+		case batch, ok := <-s.queue:
+			if !ok {
+				s.replay()
+				return
 			}
+			s.send(batch)
+		case <-s.kick:
+			s.replay()
+		case <-s.resumed:
+			s.replay()
 		}
 	}
+}
 
-	if atEOF {
-		return len(data), data, nil
+func (s *sender) send(batch []*cborLine) {
+	if err := s.insert(s.q, &insertLinesQueryVars{batch}); err != nil {
+		s.dropLines(batch, err)
+		return
 	}
 
-	return 0, nil, nil
+	slog.Debug("insert " + strconv.Itoa(len(batch)) + " line(s)")
 }
 
-var masking = []byte("***")
-
-func mask(s []byte, masks [][]byte) []byte {
-	for _, m := range masks {
-		s = bytes.ReplaceAll(s, m, masking)
+// dropLines は送信できなかった行をフォールバックファイルに書き出す。
+func (s *sender) dropLines(batch []*cborLine, cause error) {
+	if seg, err := newSegment(s.tb.ident, batch); err != nil {
+		slog.Error("lost " + strconv.Itoa(len(batch)) + " line(s): " + err.Error())
+	} else {
+		s.drop(seg, len(batch), cause)
 	}
+}
 
-	return s
+// close は残りの行を送信し終えるまで待つ。切断中であれば、送信を待っている行は
+// 再接続を待たずにフォールバックファイルに書き出す。
+func (s *sender) close() {
+	s.mu.Lock()
+	batch := s.take()
+	s.mu.Unlock()
+
+	close(s.closing)
+	s.enqueue(batch, true)
+	close(s.queue)
+	<-s.done
 }
 
-func streamReader(wg *sync.WaitGroup, r io.Reader, l chan<- *line, fd1 bool) {
-	wg.Add(1)
-	defer wg.Done()
-
-	buf := make([]byte, 4096)
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(buf, 65536)
-	scanner.Split(splitFunc)
-	masks := [][]byte{}
-	enable := true
-	endtoken := ""
-	for scanner.Scan() {
-		s := scanner.Bytes()
-		if fd1 && enable {
-			if c, _ := ghc.PraseGHC(s); c != nil {
-				switch c.Name {
-				case "debug":
-					c.OmitOpts()
-					c.Data = mask(c.Data, masks)
-					cc, err := newCommand(len(s), c)
-					if err != nil {
-						break
-					}
-					l <- cc
-					continue
-
-				case "notice", "warning", "error":
-					c.Data = mask(c.Data, masks)
-					c.Opts.String("title")
-					c.Opts.StringWithDefault("file", ".github")
-					c.Opts.NaturalNum("col")
-					c.Opts.NaturalNum("endColumn")
-					c.Opts.NaturalNumWithDefault("line", 1)
-					c.Opts.NaturalNumWithDefault("endLine", 1)
-					cc, err := newCommand(len(s), c)
-					if err != nil {
-						break
-					}
-					l <- cc
-					continue
-
-				case "group":
-					c.Data = mask(c.Data, masks)
-					c.OmitOpts()
-					cc, err := newCommand(len(s), c)
-					if err != nil {
-						break
-					}
-					l <- cc
-					continue
-
-				case "endgroup":
-					c.NameOnly()
-					cc, err := newCommand(len(s), c)
-					if err != nil {
-						break
-					}
-					l <- cc
-					continue
-
-				case "add-mask":
-					if len(c.Data) > 0 && len(ghc.TrimLeftSpace(c.Data)) > 0 {
-						masks = append(masks, c.Data)
-						continue
-					}
-
-				case "stop-commands":
-					if !enable {
-						enable = false
-						endtoken = string(c.Data)
-						continue
-					}
-
-				default:
-					if !enable && c.Name == endtoken {
-						enable = true
-						endtoken = ""
-						continue
-					}
-				}
+// replay はスプールに残っているセグメントを書き込んだ順に送信する。
+// 一時的な失敗の場合は順序を保つため、以降のセグメントは次回に持ち越す。
+// 再試行しても成功しない失敗の場合はフォールバックファイルに移す。
+func (s *sender) replay() {
+	if s.spool == nil {
+		return
+	}
+
+	paths, err := s.spool.pending()
+	if err != nil {
+		slog.Warn("spool: " + err.Error())
+		return
+	}
+
+	for _, path := range paths {
+		seg, err := s.spool.read(path)
+		if err != nil {
+			slog.Warn("spool: " + err.Error())
+			return
+		}
+
+		q := insertQuery(seg.Table, s.opt)
+		if err := s.insert(q, &insertRawQueryVars{seg.Data}); err != nil {
+			if isRetryable(err) {
+				slog.Warn(err.Error())
+				return
 			}
+
+			s.drop(seg, seg.len(), err)
+		}
+
+		if err := s.spool.remove(path); err != nil {
+			slog.Warn("spool: " + err.Error())
+			return
 		}
 
-		s = mask(s, masks)
-		l <- newLine(fd1, len(s), string(s))
+		slog.Debug("insert spooled segment " + filepath.Base(path))
+	}
+}
+
+// drain は子プロセスの終了後、出力を読み終わるのを待つ。子プロセスが残した
+// 孫プロセスが出力を開いたままにしていると終わらないため、timeout を過ぎたら
+// 読み込み口を閉じる。
+func drain(wg *sync.WaitGroup, st *streams, timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		slog.Warn("output is still open " + timeout.String() + " after the command exited, closing it")
+		st.close()
+		<-done
 	}
 }
 
-func runCmd(cmd *exec.Cmd, db *sdb.SDB, tb *table, opt *options) (int, error) {
-	stdout, err := cmd.StdoutPipe()
+func runCmd(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	f *forwarder,
+	db *sdb.SDB,
+	tb *table,
+	rs *runState,
+	opt *options,
+) (int, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 1, "", err
+	}
+
+	st, err := openStreams(cmd, opt)
 	if err != nil {
-		return 1, err
+		return 1, "", err
 	}
+	defer st.close()
 
-	stderr, err := cmd.StderrPipe()
+	fc, err := newFileCommands()
 	if err != nil {
-		return 1, err
+		return 1, "", err
+	}
+	defer fc.remove()
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = fc.inject(cmd.Env)
+
+	sp, err := openSpool(opt)
+	if err != nil {
+		return 1, "", err
+	}
+
+	s := newSender(ctx, db, tb, opt, sp)
+	// seq は stdout と stderr の goroutine ではなくここで付けて、送信する順序と揃える。
+	write := func(l *line) {
+		if l == nil {
+			return
+		}
+		l.seq = rs.nextSeq()
+		s.write(l)
 	}
 
 	q := fmt.Sprintf(START_QUERY_TEMPLATE, tb.rid)
-	_, err = db.Query(q, struct{}{})
+	_, err = db.QueryContext(ctx, q, newStartQueryVars(opt))
 	if err != nil {
-		return 1, err
+		return 1, "", err
 	}
 
 	lineChan := make(chan *line, 10)
@@ -505,20 +1193,33 @@ func runCmd(cmd *exec.Cmd, db *sdb.SDB, tb *table, opt *options) (int, error) {
 	go func() {
 		var wg sync.WaitGroup
 
-		go streamReader(&wg, stdout, lineChan, true)
-		go streamReader(&wg, stderr, lineChan, false)
+		wg.Add(1)
+		go streamReader(&wg, st.stdout, lineChan, true, rs, opt)
+		if st.stderr != nil {
+			wg.Add(1)
+			go streamReader(&wg, st.stderr, lineChan, false, rs, opt)
+		}
 
 		slog.Debug("start")
-		err := cmd.Run()
+		start := time.Now()
+		err := cmd.Start()
+		st.started()
+		if err == nil {
+			f.start()
+			err = cmd.Wait()
+			f.exit()
+			rs.wall = time.Since(start)
+			drain(&wg, st, opt.drain)
+		} else {
+			wg.Wait()
+		}
 
-		wg.Wait()
 		close(lineChan)
 
 		doneChan <- err
 		close(doneChan)
 	}()
 
-	s := newSender(db, tb, opt)
 	for {
 		select {
 		case err := <-doneChan:
@@ -527,25 +1228,35 @@ func runCmd(cmd *exec.Cmd, db *sdb.SDB, tb *table, opt *options) (int, error) {
 					break
 				}
 
-				s.write(l)
+				write(l)
 			}
 
 			if err != nil {
-				l := newLine(false, 0, err.Error())
-				s.write(l)
+				write(newLine(false, 0, err.Error()))
 			}
 
-			s.flush()
+			if err := fc.collect(rs); err != nil {
+				slog.Warn(err.Error())
+			}
 
-			return cmd.ProcessState.ExitCode(), err
+			s.close()
+
+			code, sig := exitStatus(cmd.ProcessState)
+			return code, sig, err
 
 		case l := <-lineChan:
-			s.write(l)
+			write(l)
 		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(sub(os.Args[2:]))
+		}
+	}
+
 	slog.Debug("parsing command")
 	name, args, err := getCommand()
 	if err != nil {
@@ -554,31 +1265,50 @@ func main() {
 	}
 
 	slog.Debug("parsing options")
-	opt, err := getOptions()
+	opt, err := getOptions(name)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
+	cmd := exec.Command(name, args...)
+	cmd.Env = getCmdEnv()
+	setProcAttr(cmd, opt)
+
+	// 接続が終わるまでに受信したシグナルは接続や準備を中断させる。
+	// それ以降のシグナルは f がバッファし、子プロセスの起動後に転送する。
+	ctx, stop := interruptible(context.Background())
+	f := newForwarder(ctx, cmd, opt)
+
 	slog.Debug("preparing surrealdb")
-	db, tb, err := getSurreal(opt)
+	db, tb, err := getSurreal(ctx, opt)
+	stop()
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
+	ctx = f.ctx
 
-	cmd := exec.Command(name, args...)
-	cmd.Env = getCmdEnv()
-
-	code, err := runCmd(cmd, db, tb, opt)
+	rs := newRunState()
+	code, sig, err := runCmd(ctx, cmd, f, db, tb, rs, opt)
 	if err != nil {
 		slog.Error(err.Error())
 	}
 
 	q := fmt.Sprintf(COMPLETE_QUERY_TEMPLATE, tb.rid)
-	if _, err := db.Query(q, completeQueryVars{code}); err != nil {
+	vars := completeQueryVars{
+		Code:    code,
+		Signal:  sig,
+		Outputs: rs.values(rs.outputs),
+		State:   rs.values(rs.state),
+		Env:     rs.values(rs.env),
+		Summary: rs.maskedSummary(),
+	}
+	usage(&vars, cmd, rs)
+	if _, err := db.QueryContext(context.WithoutCancel(ctx), q, vars); err != nil {
 		slog.Error(err.Error())
 	}
+	f.stop()
 
 	if err := db.Close(); err != nil {
 		slog.Error(err.Error())
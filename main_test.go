@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+// fakeSurreal は query の rpc に reply の結果を返す SurrealDB の代わり。
+// 受け取ったクエリは queries に記録する。
+type fakeSurreal struct {
+	reply   func(q string) []map[string]any
+	queries []string
+	mu      sync.Mutex
+}
+
+func (f *fakeSurreal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	up := websocket.Upgrader{Subprotocols: []string{"cbor"}}
+	ws, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	for {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req struct {
+			Id     int    `cbor:"id"`
+			Method string `cbor:"method"`
+			Params []any  `cbor:"params"`
+		}
+		if err := cbor.Unmarshal(b, &req); err != nil {
+			return
+		}
+
+		var result any
+		if req.Method == "query" {
+			q, _ := req.Params[0].(string)
+			f.mu.Lock()
+			f.queries = append(f.queries, q)
+			f.mu.Unlock()
+			result = f.reply(q)
+		}
+
+		b, _ = cbor.Marshal(map[string]any{"id": req.Id, "result": result})
+		if err := ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			return
+		}
+	}
+}
+
+func connectFake(t *testing.T, f *fakeSurreal) *sdb.SDB {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	db := &sdb.SDB{}
+	if err := db.Connect("ws" + strings.TrimPrefix(srv.URL, "http")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestInitSurrealDBExistingRun(t *testing.T) {
+	const failed = "The query was not executed due to a failed transaction"
+
+	tests := []struct {
+		name   string
+		shared bool
+		errs   map[int]string // 失敗させるステートメント
+		want   string
+	}{
+		{
+			name: "catalog entry exists",
+			errs: map[int]string{0: "Database record `catalog:x` already exists"},
+			want: "cannot create run x: Database record `catalog:x` already exists",
+		},
+		{
+			name: "table exists",
+			errs: map[int]string{1: "The table 'x' already exists"},
+			want: "cannot create run x: The table 'x' already exists",
+		},
+		{
+			name:   "shared",
+			shared: true,
+			errs:   map[int]string{0: "Database record `catalog:x` already exists"},
+			want:   "cannot create run x: Database record `catalog:x` already exists",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSurreal{
+				reply: func(q string) []map[string]any {
+					n := strings.Count(q, "-- ")
+					out := make([]map[string]any, n)
+					for i := range out {
+						out[i] = map[string]any{"status": "OK", "result": nil}
+						if len(tt.errs) > 0 {
+							out[i] = map[string]any{"status": "ERR", "result": failed}
+						}
+						if msg, ok := tt.errs[i]; ok {
+							out[i] = map[string]any{"status": "ERR", "result": msg}
+						}
+					}
+					return out
+				},
+			}
+			db := connectFake(t, f)
+
+			opt := &options{runID: "x", shared: tt.shared}
+			_, err := initSurrealDB(context.Background(), db, opt)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("err = %v, want %s", err, tt.want)
+			}
+
+			if !tt.shared && !strings.Contains(f.queries[0], "BEGIN TRANSACTION") {
+				t.Fatalf("catalog entry and table are not created in a transaction:\n%s", f.queries[0])
+			}
+		})
+	}
+}
+
+func TestGetOptionsReservedRunID(t *testing.T) {
+	t.Setenv(envPrefix+"USER", "root")
+	t.Setenv(envPrefix+"PASS", "root")
+	t.Setenv(envPrefix+"NAMESPACE", "test")
+
+	for _, id := range []string{"catalog", "counter", "line", "meta"} {
+		t.Setenv(envPrefix+"RUN_ID", id)
+		if _, err := getOptions("echo"); err == nil {
+			t.Fatalf("RUN_ID=%s: got no error", id)
+		}
+	}
+
+	t.Setenv(envPrefix+"RUN_ID", "metadata")
+	if _, err := getOptions("echo"); err != nil {
+		t.Fatal(err)
+	}
+}
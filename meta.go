@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+// version はビルド時に -ldflags "-X main.version=..." で設定される。
+var version = ""
+
+func getVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+
+	return "(devel)"
+}
+
+func getUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return strconv.Itoa(os.Getuid())
+}
+
+type startQueryVars struct {
+	Hostname string            `cbor:"hostname,omitempty"`
+	Cwd      string            `cbor:"cwd,omitempty"`
+	User     string            `cbor:"user,omitempty"`
+	Version  string            `cbor:"version"`
+	Labels   map[string]string `cbor:"labels,omitempty"`
+
+	Platform map[string]map[string]string `cbor:"platform,omitempty"`
+}
+
+func newStartQueryVars(opt *options) *startQueryVars {
+	hostname, _ := os.Hostname()
+	cwd, _ := os.Getwd()
+
+	return &startQueryVars{
+		Hostname: hostname,
+		Cwd:      cwd,
+		User:     getUser(),
+		Version:  getVersion(),
+		Labels:   opt.labels,
+		Platform: opt.platforms,
+	}
+}
+
+// usage は子プロセスの情報と資源の使用量を vars に設定する。
+// コマンドと引数には ::add-mask:: で登録された値のマスクを適用する。
+func usage(vars *completeQueryVars, cmd *exec.Cmd, rs *runState) {
+	m := rs.masks
+	vars.Command = string(m.mask([]byte(cmd.Args[0])))
+	vars.Args = make([]string, 0, len(cmd.Args)-1)
+	for _, a := range cmd.Args[1:] {
+		vars.Args = append(vars.Args, string(m.mask([]byte(a))))
+	}
+
+	if rs.wall > 0 {
+		vars.WallTime = sdb.Duration(&rs.wall)
+	}
+
+	ps := cmd.ProcessState
+	if ps == nil {
+		return
+	}
+
+	vars.Pid = ps.Pid()
+	ut, st := ps.UserTime(), ps.SystemTime()
+	vars.UserTime = sdb.Duration(&ut)
+	vars.SystemTime = sdb.Duration(&st)
+	vars.MaxRss = maxRss(ps)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// maxRss は 0 を返す。Unix 以外では最大常駐セットサイズを記録しない。
+func maxRss(ps *os.ProcessState) int64 {
+	return 0
+}
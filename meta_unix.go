@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// maxRss は子プロセスの最大常駐セットサイズをバイト単位で返す。
+func maxRss(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+
+	// darwin ではバイト単位、それ以外では KiB 単位。
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		return int64(ru.Maxrss)
+	}
+
+	return int64(ru.Maxrss) * 1024
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+// migrations はデータベースのスキーマを 1 つずつ新しいバージョンにするクエリ。
+// i 番目の要素を適用するとバージョン i+1 になる。既に適用されていても壊れないように、
+// フィールドとインデックスは OVERWRITE で定義し直す。適用済みの要素は変更せず、
+// スキーマを変えるときは末尾に追加する。
+var migrations = []string{
+	// 1: 実行の番号と一覧
+	`
+DEFINE TABLE IF NOT EXISTS counter SCHEMAFULL;   -- 0
+DEFINE FIELD OVERWRITE value ON counter TYPE int; -- 1
+
+DEFINE TABLE IF NOT EXISTS catalog SCHEMAFULL;                            -- 2
+DEFINE FIELD OVERWRITE startedAt   ON catalog TYPE option<datetime>;       -- 3
+DEFINE FIELD OVERWRITE completedAt ON catalog TYPE option<datetime>;       -- 4
+DEFINE FIELD OVERWRITE exitCode    ON catalog TYPE option<int>;            -- 5
+DEFINE FIELD OVERWRITE signal      ON catalog TYPE option<string>;         -- 6
+DEFINE FIELD OVERWRITE outputs     ON catalog FLEXIBLE TYPE option<object>; -- 7
+DEFINE FIELD OVERWRITE state       ON catalog FLEXIBLE TYPE option<object>; -- 8
+DEFINE FIELD OVERWRITE env         ON catalog FLEXIBLE TYPE option<object>; -- 9
+DEFINE FIELD OVERWRITE summary     ON catalog TYPE option<string>;         -- 10
+DEFINE FIELD OVERWRITE command     ON catalog TYPE option<string>;         -- 11
+DEFINE FIELD OVERWRITE args        ON catalog TYPE option<array<string>>;  -- 12
+DEFINE FIELD OVERWRITE cwd         ON catalog TYPE option<string>;         -- 13
+DEFINE FIELD OVERWRITE hostname    ON catalog TYPE option<string>;         -- 14
+DEFINE FIELD OVERWRITE pid         ON catalog TYPE option<int>;            -- 15
+DEFINE FIELD OVERWRITE user        ON catalog TYPE option<string>;         -- 16
+DEFINE FIELD OVERWRITE version     ON catalog TYPE option<string>;         -- 17
+DEFINE FIELD OVERWRITE wallTime    ON catalog TYPE option<duration>;       -- 18
+DEFINE FIELD OVERWRITE userTime    ON catalog TYPE option<duration>;       -- 19
+DEFINE FIELD OVERWRITE systemTime  ON catalog TYPE option<duration>;       -- 20
+DEFINE FIELD OVERWRITE maxRss      ON catalog TYPE option<int>;            -- 21
+DEFINE FIELD OVERWRITE labels      ON catalog FLEXIBLE TYPE option<object>; -- 22
+DEFINE FIELD OVERWRITE platform    ON catalog FLEXIBLE TYPE option<object>; -- 23
+DEFINE FIELD OVERWRITE layout      ON catalog TYPE option<string>;         -- 24`,
+
+	// 2: shared レイアウトの行
+	`
+DEFINE TABLE IF NOT EXISTS line SCHEMAFULL;                       -- 0
+DEFINE FIELD OVERWRITE run    ON line TYPE record<catalog>;        -- 1
+DEFINE FIELD OVERWRITE seq    ON line TYPE int;                    -- 2
+DEFINE FIELD OVERWRITE lineNo ON line TYPE option<int>;            -- 3
+DEFINE FIELD OVERWRITE kind   ON line TYPE -1 | 1 | 2;             -- 4
+DEFINE FIELD OVERWRITE time   ON line TYPE datetime;               -- 5
+DEFINE FIELD OVERWRITE text   ON line TYPE string;                 -- 6
+DEFINE FIELD OVERWRITE data   ON line TYPE option<string>;         -- 7
+DEFINE FIELD OVERWRITE opts   ON line FLEXIBLE TYPE option<object>; -- 8
+DEFINE INDEX OVERWRITE line_run  ON line FIELDS run, seq;          -- 9
+DEFINE INDEX OVERWRITE line_time ON line FIELDS time;              -- 10
+DEFINE INDEX OVERWRITE line_kind ON line FIELDS kind, time;        -- 11`,
+}
+
+// schemaVersion はこのバイナリが扱えるスキーマのバージョン。
+var schemaVersion = len(migrations)
+
+const (
+	SCHEMA_VERSION_QUERY = `
+RETURN meta:schema.version ?? 0; -- 0`
+
+	MIGRATION_QUERY_TEMPLATE = `
+BEGIN TRANSACTION;
+%s
+UPSERT meta:schema SET version = %d, updatedAt = time::now() RETURN NONE;
+COMMIT TRANSACTION;`
+)
+
+func getSchemaVersion(ctx context.Context, db *sdb.SDB) (int, error) {
+	r, err := db.QueryContext(ctx, SCHEMA_VERSION_QUERY, struct{}{})
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := sdb.At[int](r, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return *v, nil
+}
+
+// ensureSchema はスキーマのバージョンを確認し、apply が true であれば
+// 未適用のマイグレーションを順に適用する。データベースのスキーマが
+// このバイナリより新しい場合は、書き込まずにエラーを返す。
+func ensureSchema(ctx context.Context, db *sdb.SDB, apply bool) (int, error) {
+	v, err := getSchemaVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case v > schemaVersion:
+		return v, errors.New(
+			"database schema version " + strconv.Itoa(v) +
+				" is newer than " + strconv.Itoa(schemaVersion) +
+				", which this version of surreallog supports",
+		)
+	case v == schemaVersion:
+		return v, nil
+	case !apply:
+		return v, errors.New(
+			"database schema version " + strconv.Itoa(v) +
+				" is older than " + strconv.Itoa(schemaVersion) +
+				", run surreallog migrate",
+		)
+	}
+
+	for ; v < schemaVersion; v++ {
+		slog.Info("migrating schema to version " + strconv.Itoa(v+1))
+		q := fmt.Sprintf(MIGRATION_QUERY_TEMPLATE, migrations[v], v+1)
+		r, err := db.QueryContext(ctx, q, struct{}{})
+		if err == nil {
+			err = sdb.Check(r)
+		}
+		if err != nil {
+			return v, err
+		}
+	}
+
+	return v, nil
+}
+
+// migrateMain は surreallog migrate を実行する。
+func migrateMain(args []string) int {
+	if len(args) != 2 {
+		slog.Error("usage: surreallog migrate <ns> <db>")
+		return 1
+	}
+
+	opt, err := getConnOptions()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	opt.ns, opt.db = args[0], args[1]
+	opt.migrate = true
+
+	ctx, stop := interruptible(context.Background())
+	defer stop()
+
+	db, err := connectSurreal(ctx, opt)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	v, err := getSchemaVersion(ctx, db)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	fmt.Fprintln(os.Stdout, "schema version "+strconv.Itoa(v))
+
+	return 0
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// platformEnv はテンプレートで使う変数名と、その値を持つ環境変数の名前の組。
+type platformEnv struct {
+	name string
+	env  string
+}
+
+type platformDef struct {
+	name   string
+	detect func() bool
+	vars   []platformEnv
+}
+
+func envIs(name, value string) func() bool {
+	return func() bool {
+		return strings.EqualFold(os.Getenv(name), value)
+	}
+}
+
+func envSet(name string) func() bool {
+	return func() bool {
+		return os.Getenv(name) != ""
+	}
+}
+
+var platformDefs = []platformDef{
+	{
+		// POD_NAME などは downward API で設定する。
+		// https://kubernetes.io/docs/concepts/workloads/pods/downward-api/
+		name:   "kubernetes",
+		detect: envSet("KUBERNETES_SERVICE_HOST"),
+		vars: []platformEnv{
+			{"pod_name", "POD_NAME"},
+			{"pod_namespace", "POD_NAMESPACE"},
+			{"pod_uid", "POD_UID"},
+			{"node_name", "NODE_NAME"},
+		},
+	},
+	{
+		name:   "github",
+		detect: envIs("GITHUB_ACTIONS", "true"),
+		vars: []platformEnv{
+			{"github_repository", "GITHUB_REPOSITORY"},
+			{"github_workflow", "GITHUB_WORKFLOW"},
+			{"github_job", "GITHUB_JOB"},
+			{"github_run_id", "GITHUB_RUN_ID"},
+			{"github_run_number", "GITHUB_RUN_NUMBER"},
+			{"github_run_attempt", "GITHUB_RUN_ATTEMPT"},
+			{"github_ref", "GITHUB_REF"},
+			{"github_sha", "GITHUB_SHA"},
+			{"github_actor", "GITHUB_ACTOR"},
+		},
+	},
+	{
+		name:   "gitlab",
+		detect: envIs("GITLAB_CI", "true"),
+		vars: []platformEnv{
+			{"gitlab_project_path", "CI_PROJECT_PATH"},
+			{"gitlab_pipeline_id", "CI_PIPELINE_ID"},
+			{"gitlab_job_id", "CI_JOB_ID"},
+			{"gitlab_job_name", "CI_JOB_NAME"},
+			{"gitlab_ref", "CI_COMMIT_REF_NAME"},
+			{"gitlab_sha", "CI_COMMIT_SHA"},
+		},
+	},
+	{
+		name:   "jenkins",
+		detect: envSet("JENKINS_URL"),
+		vars: []platformEnv{
+			{"jenkins_job_name", "JOB_NAME"},
+			{"jenkins_build_number", "BUILD_NUMBER"},
+			{"jenkins_build_id", "BUILD_ID"},
+			{"jenkins_node_name", "NODE_NAME"},
+			{"jenkins_git_commit", "GIT_COMMIT"},
+		},
+	},
+}
+
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// detectPlatforms は実行環境を検出し、環境ごとにテンプレートで使う変数の値を返す。
+// 値が設定されていない変数は含めない。
+func detectPlatforms() map[string]map[string]string {
+	platforms := map[string]map[string]string{}
+	for _, def := range platformDefs {
+		if !def.detect() {
+			continue
+		}
+
+		vars := map[string]string{}
+		for _, v := range def.vars {
+			if s := os.Getenv(v.env); s != "" {
+				vars[v.name] = s
+			}
+		}
+		platforms[def.name] = vars
+	}
+
+	// downward API を使っていなくても、名前空間はサービスアカウントから分かる。
+	if k, ok := platforms["kubernetes"]; ok && k["pod_namespace"] == "" {
+		if b, err := os.ReadFile(serviceAccountNamespace); err == nil {
+			if s := strings.TrimSpace(string(b)); s != "" {
+				k["pod_namespace"] = s
+			}
+		}
+	}
+
+	return platforms
+}
+
+// platformVar は検出された環境の変数の値を返す。
+func platformVar(platforms map[string]map[string]string, name string) (string, bool) {
+	for _, vars := range platforms {
+		if v, ok := vars[name]; ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+const (
+	LIST_RUNS_QUERY = `
+SELECT record::id(id) AS key, startedAt, completedAt, layout FROM catalog; -- 0`
+
+	COUNT_TABLE_LINES_QUERY_TEMPLATE = `
+RETURN (SELECT count() FROM %s GROUP ALL)[0].count ?? 0; -- 0`
+
+	COUNT_SHARED_LINES_QUERY = `
+RETURN (SELECT count() FROM line WHERE run = $run GROUP ALL)[0].count ?? 0; -- 0`
+
+	// 実行の一覧と行が食い違わないように、まとめて削除する。
+	REMOVE_TABLE_RUN_QUERY_TEMPLATE = `
+BEGIN TRANSACTION;
+REMOVE TABLE IF EXISTS %s;
+DELETE $run RETURN NONE;
+COMMIT TRANSACTION;`
+
+	REMOVE_SHARED_RUN_QUERY = `
+BEGIN TRANSACTION;
+DELETE line WHERE run = $run RETURN NONE;
+DELETE $run RETURN NONE;
+COMMIT TRANSACTION;`
+)
+
+// reservedTables は surreallog が使うテーブル。実行の ID と同じ名前でも削除しない。
+var reservedTables = map[string]bool{
+	"catalog": true,
+	"counter": true,
+	"line":    true,
+	"meta":    true,
+}
+
+var retentionRe = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// parseRetention は time.ParseDuration の書式に加えて、30d や 2w のような日数と週数を受け付ける。
+func parseRetention(s string) (time.Duration, error) {
+	m := retentionRe.FindStringSubmatch(s)
+	if m == nil {
+		return time.ParseDuration(s)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	unit := 24 * time.Hour
+	if m[2] == "w" {
+		unit *= 7
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// pruning は実行を削除する条件が指定されているかどうかを返す。
+func (opt *options) pruning() bool {
+	return opt.retention > 0 || opt.stale > 0 || opt.maxRuns > 0 || opt.maxLines > 0
+}
+
+type runEntry struct {
+	Key         any      `cbor:"key"`
+	StartedAt   sdb.Time `cbor:"startedAt"`
+	CompletedAt sdb.Time `cbor:"completedAt"`
+	Layout      string   `cbor:"layout"`
+	lines       int64
+}
+
+func (r *runEntry) id() string {
+	s, _ := r.Key.(string)
+	return s
+}
+
+func (r *runEntry) completed() bool {
+	return !r.CompletedAt.IsZero()
+}
+
+func countLines(ctx context.Context, db *sdb.SDB, r *runEntry) (int64, error) {
+	q := fmt.Sprintf(COUNT_TABLE_LINES_QUERY_TEMPLATE, sdb.QuoteIdent(r.id()))
+	if r.Layout == "shared" {
+		q = COUNT_SHARED_LINES_QUERY
+	}
+
+	res, err := db.QueryContext(ctx, q, map[string]any{
+		"run": sdb.RecordID("catalog", r.id()),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := sdb.At[int64](res, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return *n, nil
+}
+
+func removeRun(ctx context.Context, db *sdb.SDB, r *runEntry) error {
+	q := REMOVE_SHARED_RUN_QUERY
+	if r.Layout != "shared" && !reservedTables[r.id()] {
+		q = fmt.Sprintf(REMOVE_TABLE_RUN_QUERY_TEMPLATE, sdb.QuoteIdent(r.id()))
+	}
+
+	res, err := db.QueryContext(ctx, q, map[string]any{
+		"run": sdb.RecordID("catalog", r.id()),
+	})
+	if err != nil {
+		return err
+	}
+
+	return sdb.Check(res)
+}
+
+// prune は opt の条件に当てはまる実行を、その行と一緒に削除する。
+// 完了していない実行は別の場所で書き込み中かもしれないため、
+// SURREALLOG_STALE_AFTER より前に開始した場合にだけ削除する。
+// dryRun が true であれば削除せず、削除する実行を report に渡すだけにする。
+func prune(
+	ctx context.Context,
+	db *sdb.SDB,
+	opt *options,
+	dryRun bool,
+	report func(msg string),
+) error {
+	res, err := db.QueryContext(ctx, LIST_RUNS_QUERY, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	runs, err := sdb.At[[]*runEntry](res, 0)
+	if err != nil {
+		return err
+	}
+
+	// 新しい順に並べる。開始していない実行は最も古いものとして扱う。
+	sort.SliceStable(*runs, func(i, j int) bool {
+		return (*runs)[i].StartedAt.After((*runs)[j].StartedAt.Time)
+	})
+
+	now := time.Now()
+	cutoff, staleCutoff := now.Add(-opt.retention), now.Add(-opt.stale)
+	kept, total := 0, int64(0)
+	for _, r := range *runs {
+		if r.id() == "" {
+			slog.Warn(fmt.Sprintf("skipping run with unexpected id %v", r.Key))
+			continue
+		}
+
+		if opt.maxLines > 0 {
+			r.lines, err = countLines(ctx, db, r)
+			if err != nil {
+				return err
+			}
+		}
+
+		reason := ""
+		switch {
+		case !r.completed():
+			// 開始時刻のない実行は作られたばかりかもしれないので、古いとはみなさない。
+			if opt.stale > 0 && !r.StartedAt.IsZero() && r.StartedAt.Before(staleCutoff) {
+				reason = "not completed within " + opt.stale.String()
+			}
+		case opt.retention > 0 && r.CompletedAt.Before(cutoff):
+			reason = "completed more than " + opt.retention.String() + " ago"
+		case opt.maxRuns > 0 && kept >= opt.maxRuns:
+			reason = "more than " + strconv.Itoa(opt.maxRuns) + " runs"
+		case opt.maxLines > 0 && total+r.lines > opt.maxLines:
+			reason = "more than " + strconv.FormatInt(opt.maxLines, 10) + " lines"
+			// 古い実行の行数が少なくても、新しい実行より先に残さない。
+			total = opt.maxLines + 1
+		}
+
+		if reason == "" {
+			kept++
+			total += r.lines
+			continue
+		}
+
+		msg := "run " + r.id() + " (" + reason + ")"
+		if dryRun {
+			report("would remove " + msg)
+			continue
+		}
+
+		if err := removeRun(ctx, db, r); err != nil {
+			return err
+		}
+		report("removed " + msg)
+	}
+
+	return nil
+}
+
+// pruneMain は surreallog prune を実行する。
+func pruneMain(args []string) int {
+	dryRun := false
+	var names []string
+	for _, arg := range args {
+		if arg == "--dry-run" {
+			dryRun = true
+		} else {
+			names = append(names, arg)
+		}
+	}
+	if len(names) != 2 {
+		slog.Error("usage: surreallog prune <ns> <db> [--dry-run]")
+		return 1
+	}
+
+	opt, err := getConnOptions()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if err := getPruneOptions(opt); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	opt.ns, opt.db = names[0], names[1]
+	if !opt.pruning() {
+		slog.Error(
+			"env." + envPrefix + "RETENTION, env." + envPrefix + "STALE_AFTER, env." +
+				envPrefix + "MAX_RUNS or env." + envPrefix + "MAX_LINES is required",
+		)
+		return 1
+	}
+
+	ctx, stop := interruptible(context.Background())
+	defer stop()
+
+	// 削除するだけなので、名前空間やデータベースを定義したりマイグレーションしたりしない。
+	db, err := useSurreal(ctx, opt)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	if v, err := getSchemaVersion(ctx, db); err != nil {
+		slog.Error(err.Error())
+		return 1
+	} else if v == 0 {
+		slog.Error("no surreallog schema found in namespace " + opt.ns + ", database " + opt.db)
+		return 1
+	}
+	if _, err := ensureSchema(ctx, db, false); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	err = prune(ctx, db, opt, dryRun, func(msg string) {
+		fmt.Fprintln(os.Stdout, msg)
+	})
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
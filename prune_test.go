@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "2w", want: 14 * 24 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "12h", want: 12 * time.Hour},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "-1h", want: -time.Hour},
+		{in: "", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "1d12h", wantErr: true},
+		{in: "30D", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRetention(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) cbor.Tag {
+		t := now.Add(-d)
+		return cbor.Tag{Number: 12, Content: []int64{t.Unix(), int64(t.Nanosecond())}}
+	}
+	day := 24 * time.Hour
+
+	runs := []map[string]any{
+		{"key": "completed-long-ago", "startedAt": ago(41 * day), "completedAt": ago(40 * day)},
+		{"key": "long-run", "startedAt": ago(41 * day), "completedAt": ago(day)},
+		{"key": "running", "startedAt": ago(40 * day)},
+		{"key": "just-created"},
+		{"key": "recent", "startedAt": ago(2 * day), "completedAt": ago(2 * day)},
+	}
+
+	tests := []struct {
+		name string
+		opt  *options
+		want []string
+	}{
+		{
+			name: "retention",
+			opt:  &options{retention: 30 * day},
+			want: []string{"would remove run completed-long-ago (completed more than 720h0m0s ago)"},
+		},
+		{
+			name: "stale",
+			opt:  &options{stale: 7 * day},
+			want: []string{"would remove run running (not completed within 168h0m0s)"},
+		},
+		{
+			name: "max runs",
+			opt:  &options{maxRuns: 1},
+			want: []string{
+				"would remove run completed-long-ago (more than 1 runs)",
+				"would remove run long-run (more than 1 runs)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSurreal{
+				reply: func(q string) []map[string]any {
+					return []map[string]any{{"status": "OK", "result": runs}}
+				},
+			}
+			db := connectFake(t, f)
+
+			got := []string{}
+			err := prune(context.Background(), db, tt.opt, true, func(msg string) {
+				got = append(got, msg)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
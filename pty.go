@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/tai-kun/surreallog/internal/pty"
+)
+
+// streams は子プロセスの stdout と stderr の読み込み口。
+// 擬似端末で stderr をまとめる場合は stderr が nil になる。
+//
+// cmd.StdoutPipe は Wait で閉じられ、子プロセスが残した孫プロセスが書き込み口を
+// 持ち続けていても読み込みを終わらせられないため、パイプは自分で作って閉じる。
+type streams struct {
+	stdout io.Reader
+	stderr io.Reader
+	files  []*os.File // 親プロセス側の読み込み口
+	child  []*os.File // 子プロセスに渡す書き込み口。起動後に親プロセス側では閉じる
+}
+
+func (st *streams) pipe() (io.Reader, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st.files = append(st.files, r)
+	st.child = append(st.child, w)
+
+	return r, w, nil
+}
+
+func openStreams(cmd *exec.Cmd, opt *options) (*streams, error) {
+	st := &streams{}
+	if !opt.pty {
+		stdout, w, err := st.pipe()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdout = w
+
+		stderr, w, err := st.pipe()
+		if err != nil {
+			st.close()
+			return nil, err
+		}
+		cmd.Stderr = w
+
+		st.stdout, st.stderr = stdout, stderr
+		return st, nil
+	}
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	st.stdout = pty.NewReader(ptmx)
+	st.files = append(st.files, ptmx)
+	st.child = append(st.child, tty)
+	if err := pty.Setsize(tty, opt.ptyCols, opt.ptyRows); err != nil {
+		st.close()
+		return nil, err
+	}
+
+	cmd.Stdout = tty
+	if opt.ptyMerge {
+		cmd.Stderr = tty
+	} else {
+		var w *os.File
+		st.stderr, w, err = st.pipe()
+		if err != nil {
+			st.close()
+			return nil, err
+		}
+		cmd.Stderr = w
+	}
+
+	return st, nil
+}
+
+// started は子プロセスの起動後に呼ばれ、親プロセス側の書き込み口を閉じる。
+// 子プロセスとその子孫がすべて書き込み口を閉じると読み込みが終わる。
+func (st *streams) started() {
+	for _, f := range st.child {
+		f.Close()
+	}
+	st.child = nil
+}
+
+// close は読み込み口も閉じる。読み込み中であれば os.ErrClosed で終わる。
+func (st *streams) close() {
+	st.started()
+	for _, f := range st.files {
+		f.Close()
+	}
+	st.files = nil
+}
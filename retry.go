@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+// 一時的な失敗を表す SurrealDB のエラーメッセージの一部。
+var retryableMessages = []string{
+	"can be retried",
+	"conflict",
+	"timed out",
+	"timeout",
+}
+
+func isRetryable(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, sdb.ErrClosed):
+		return false
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, sdb.ErrDisconnected):
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jitter は d の半分から d までのランダムな時間を返す。
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + rand.N(d/2)
+}
+
+// waitConnected は再接続中であれば、再接続するか諦めるまで待つ。
+// 終了処理中は待たずに sdb.ErrDisconnected を返す。
+func (s *sender) waitConnected() error {
+	for s.db.Reconnecting() {
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-s.closing:
+			return sdb.ErrDisconnected
+		case <-s.resumed:
+		}
+	}
+
+	return nil
+}
+
+// insert はクエリを実行し、一時的な失敗であれば opt.retryMax 回まで再試行する。
+// 再接続中は再接続を待ってから実行し、待っている間の失敗は回数に数えない。
+func (s *sender) insert(q string, vars any) error {
+	delay := s.opt.retryDelay
+	for n := 0; ; n++ {
+		if err := s.waitConnected(); err != nil {
+			return err
+		}
+
+		r, err := s.db.QueryContext(s.ctx, q, vars)
+		if err == nil {
+			err = sdb.Check(r)
+		}
+		if err != nil && s.db.Reconnecting() && isRetryable(err) && s.ctx.Err() == nil {
+			slog.Warn(err.Error() + " (waiting for reconnect)")
+			n--
+			continue
+		}
+		if err == nil || n >= s.opt.retryMax || !isRetryable(err) {
+			return err
+		}
+		// 再接続を諦めた後は再試行しても成功しない。
+		if s.lost.Load() && errors.Is(err, sdb.ErrDisconnected) {
+			return err
+		}
+
+		d := jitter(delay)
+		slog.Warn(
+			err.Error() + " (retry " + strconv.Itoa(n+1) + "/" +
+				strconv.Itoa(s.opt.retryMax) + " in " + d.String() + ")",
+		)
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		delay *= 2
+	}
+}
+
+// drop は送信できなかったセグメントをフォールバックファイルに書き出す。
+func (s *sender) drop(seg *segment, n int, cause error) {
+	if err := appendFallback(s.opt.fallback, seg); err != nil {
+		slog.Error(
+			"lost " + strconv.Itoa(n) + " line(s): " + cause.Error() +
+				" (" + err.Error() + ")",
+		)
+		return
+	}
+
+	slog.Error(
+		"dropped " + strconv.Itoa(n) + " line(s) into " + s.opt.fallback +
+			": " + cause.Error(),
+	)
+}
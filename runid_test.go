@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewULID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := newULID()
+	after := time.Now().UnixMilli()
+
+	if len(id) != 26 {
+		t.Fatalf("len(%q) = %d, want 26", id, len(id))
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(crockford, c) {
+			t.Fatalf("%q contains %q, which is not in the alphabet", id, c)
+		}
+	}
+	// 128 ビットを超えないように、先頭の文字は 3 ビットに収まる。
+	if id[0] > '7' {
+		t.Fatalf("%q: first character is out of range", id)
+	}
+
+	// 先頭の 10 文字は 48 ビットのミリ秒。
+	ms := int64(0)
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if ms < before || ms > after {
+		t.Fatalf("%q: timestamp = %d, want between %d and %d", id, ms, before, after)
+	}
+
+	// 時刻が進めば辞書順でも後ろになる。
+	time.Sleep(2 * time.Millisecond)
+	if next := newULID(); next <= id {
+		t.Fatalf("%q is not after %q", next, id)
+	}
+}
+
+func TestNewUUIDv7(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for range 100 {
+		if id := newUUIDv7(); !re.MatchString(id) {
+			t.Fatalf("%q is not a UUID version 7", id)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+// 既存のインデックスを作り直さないように、インデックスは IF NOT EXISTS で定義する。
+// アナライザーの名前は設定ごとに異なるため、既存のアナライザーを変えることはない。
+const DEFINE_SEARCH_QUERY_TEMPLATE = `
+DEFINE ANALYZER IF NOT EXISTS %s TOKENIZERS %s FILTERS %s;                                   -- 0
+DEFINE INDEX IF NOT EXISTS text_search ON %s FIELDS text SEARCH ANALYZER %s BM25 HIGHLIGHTS; -- 1
+DEFINE INDEX IF NOT EXISTS data_search ON %s FIELDS data SEARCH ANALYZER %s BM25 HIGHLIGHTS; -- 2`
+
+var (
+	tokenizerRe = regexp.MustCompile(`^(blank|camel|class|punct)$`)
+	filterRe    = regexp.MustCompile(
+		`^(ascii|lowercase|uppercase|(edgengram|ngram)\(\d+,\d+\)|snowball\([a-z]+\))$`,
+	)
+)
+
+// splitList はカンマ区切りの値を分割する。edgengram(2,10) のような括弧の中のカンマでは
+// 分割せず、値の空白は取り除く。
+func splitList(s string) []string {
+	list := []string{}
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				list = append(list, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	list = append(list, s[start:])
+
+	for i, v := range list {
+		list[i] = strings.ToLower(strings.Join(strings.Fields(v), ""))
+	}
+
+	return list
+}
+
+// parseSearchList は SURREALLOG_SEARCH_TOKENIZERS や SURREALLOG_SEARCH_FILTERS の値を検証し、
+// SurrealQL にそのまま埋め込める形にする。
+func parseSearchList(env, s string, re *regexp.Regexp) (string, error) {
+	list := splitList(s)
+	for _, v := range list {
+		if !re.MatchString(v) {
+			return "", errors.New("env." + env + ": invalid value " + v)
+		}
+	}
+
+	return strings.Join(list, ","), nil
+}
+
+// analyzerName は SURREALLOG_SEARCH_TOKENIZERS と SURREALLOG_SEARCH_FILTERS から
+// アナライザーの名前を決める。同じ設定であれば同じ名前になる。
+func analyzerName(opt *options) string {
+	h := sha256.Sum256([]byte(opt.tokenizers + ";" + opt.filters))
+	return "surreallog_" + hex.EncodeToString(h[:6])
+}
+
+// defineSearchIndexes は全文検索のアナライザーと、tb の text と data のインデックスを定義する。
+func defineSearchIndexes(ctx context.Context, db *sdb.SDB, tb string, opt *options) error {
+	an := analyzerName(opt)
+	q := fmt.Sprintf(
+		DEFINE_SEARCH_QUERY_TEMPLATE,
+		an, opt.tokenizers, opt.filters, tb, an, tb, an,
+	)
+	r, err := db.QueryContext(ctx, q, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	return sdb.Check(r)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestAnalyzerName(t *testing.T) {
+	a := analyzerName(&options{tokenizers: "blank,class", filters: "lowercase"})
+	if !regexp.MustCompile(`^surreallog_[0-9a-f]{12}$`).MatchString(a) {
+		t.Fatalf("%q is not a valid analyzer name", a)
+	}
+
+	if b := analyzerName(&options{tokenizers: "blank,class", filters: "lowercase"}); b != a {
+		t.Fatalf("same configuration: got %q and %q", a, b)
+	}
+
+	for _, opt := range []*options{
+		{tokenizers: "blank", filters: "lowercase"},
+		{tokenizers: "blank,class", filters: "lowercase,ascii"},
+		{tokenizers: "blank,class,lowercase", filters: ""},
+	} {
+		if b := analyzerName(opt); b == a {
+			t.Fatalf("%q %q: got the same name %q", opt.tokenizers, opt.filters, b)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownSignals = []os.Signal{
+	syscall.SIGTERM,
+	syscall.SIGINT,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+
+	return "SIG" + strconv.Itoa(int(sig))
+}
+
+func isTerminating(sig os.Signal) bool {
+	return slices.Contains(shutdownSignals, sig)
+}
+
+// interruptible は終了シグナルを受信するとキャンセルされるコンテキストを返す。
+// signal.NotifyContext と異なり、stop はコンテキストをキャンセルせずに受信だけを止める。
+func interruptible(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	sigs := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(sigs, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-sigs:
+			slog.Debug("received " + sig.String())
+			cancel()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(done)
+		})
+	}
+}
+
+// exitStatus は終了コードと、シグナルで終了した場合はそのシグナル名を返す。
+// シグナルで終了した場合の終了コードはシェルの慣習に倣って 128+n とする。
+func exitStatus(ps *os.ProcessState) (int, string) {
+	if ps == nil {
+		return -1, ""
+	}
+
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), signalName(ws.Signal())
+	}
+
+	return ps.ExitCode(), ""
+}
+
+type forwarder struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cmd    *exec.Cmd
+	opt    *options
+	sigs   chan os.Signal
+	done   chan bool
+	timer  *time.Timer
+	exited atomic.Bool
+	once   sync.Once
+	mu     sync.Mutex
+}
+
+// newForwarder はシグナルの受信を開始する。子プロセスの起動前に受信した
+// シグナルは start が呼ばれるまでバッファされる。
+//
+// f.ctx は子プロセスの終了後の送信に使うコンテキストで、子プロセスの終了後に
+// 終了シグナルを受信するか、終了シグナルから猶予期間が過ぎるとキャンセルされる。
+func newForwarder(parent context.Context, cmd *exec.Cmd, opt *options) *forwarder {
+	ctx, cancel := context.WithCancel(parent)
+	f := &forwarder{
+		ctx:    ctx,
+		cancel: cancel,
+		cmd:    cmd,
+		opt:    opt,
+		sigs:   make(chan os.Signal, len(forwardedSignals)),
+		done:   make(chan bool),
+	}
+	signal.Notify(f.sigs, forwardedSignals...)
+
+	return f
+}
+
+func (f *forwarder) start() {
+	go func() {
+		for {
+			select {
+			case <-f.done:
+				return
+			case sig := <-f.sigs:
+				f.forward(sig)
+			}
+		}
+	}()
+}
+
+// exit は子プロセスが終了したときに呼ばれる。以降のシグナルは転送しない。
+func (f *forwarder) exit() {
+	f.exited.Store(true)
+}
+
+func (f *forwarder) stop() {
+	f.once.Do(func() {
+		signal.Stop(f.sigs)
+		close(f.done)
+		f.cancel()
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.timer != nil {
+			f.timer.Stop()
+			f.timer = nil
+		}
+	})
+}
+
+func (f *forwarder) forward(sig os.Signal) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+
+	if f.exited.Load() {
+		// 残りの行の送信を待たずに終わらせる。
+		if isTerminating(sig) {
+			slog.Debug("received " + signalName(s) + ", canceling")
+			f.cancel()
+		}
+		return
+	}
+
+	slog.Debug("forward " + signalName(s))
+	if err := f.kill(s); err != nil {
+		slog.Warn(err.Error())
+	}
+
+	if !isTerminating(sig) {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		return
+	}
+	f.timer = time.AfterFunc(f.opt.gp, func() {
+		if f.exited.Load() {
+			slog.Warn("grace period of " + f.opt.gp.String() + " exceeded, canceling")
+			f.cancel()
+			return
+		}
+
+		slog.Warn("grace period of " + f.opt.gp.String() + " exceeded, sending SIGKILL")
+		if err := f.kill(syscall.SIGKILL); err != nil {
+			slog.Warn(err.Error())
+		}
+	})
+}
@@ -0,0 +1,40 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM,
+	syscall.SIGINT,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+// setProcAttr は何もしない。擬似端末とプロセスグループは Unix でのみ使える。
+func setProcAttr(cmd *exec.Cmd, opt *options) {}
+
+// kill は子プロセスにだけ送る。Windows で送れるのは SIGKILL だけで、
+// それ以外はエラーになるため、終了シグナルは猶予期間の後に SIGKILL になる。
+func (f *forwarder) kill(sig syscall.Signal) error {
+	return f.cmd.Process.Signal(sig)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const spoolExt = ".cbor"
+
+// segment は送信前に書き出される 1 バッチ分の行。送信先のテーブルを含むため、
+// 別の実行で再送しても元の実行のテーブルに挿入される。
+type segment struct {
+	Table string          `cbor:"table"`
+	Data  cbor.RawMessage `cbor:"data"`
+}
+
+type insertRawQueryVars struct {
+	Data cbor.RawMessage `cbor:"data"`
+}
+
+type spool struct {
+	dir string
+	seq atomic.Uint64
+}
+
+// openSpool は名前空間とデータベースごとのスプールディレクトリを開く。
+func openSpool(opt *options) (*spool, error) {
+	if opt.spoolDir == "" {
+		return nil, nil
+	}
+
+	dir := filepath.Join(
+		opt.spoolDir,
+		url.PathEscape(opt.ns),
+		url.PathEscape(opt.db),
+	)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &spool{dir: dir}, nil
+}
+
+func newSegment(tb string, data []*cborLine) (*segment, error) {
+	b, err := cbor.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segment{
+		Table: tb,
+		Data:  b,
+	}, nil
+}
+
+func (seg *segment) len() int {
+	var data []cbor.RawMessage
+	if err := cbor.Unmarshal(seg.Data, &data); err != nil {
+		return 0
+	}
+
+	return len(data)
+}
+
+func (sp *spool) write(tb string, data []*cborLine) error {
+	seg, err := newSegment(tb, data)
+	if err != nil {
+		return err
+	}
+
+	b, err := cbor.Marshal(seg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), sp.seq.Add(1))
+	tmp := filepath.Join(sp.dir, "."+name)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+
+	// 書き込み途中のセグメントを再送しないように、書き込み後に名前を変更する。
+	return os.Rename(tmp, filepath.Join(sp.dir, name+spoolExt))
+}
+
+// pending は未送信のセグメントを書き込んだ順に返す。
+func (sp *spool) pending() ([]string, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(sp.dir, name))
+	}
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+func (sp *spool) read(path string) (*segment, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var seg segment
+	if err := cbor.Unmarshal(b, &seg); err != nil {
+		return nil, err
+	}
+
+	return &seg, nil
+}
+
+func (sp *spool) remove(path string) error {
+	return os.Remove(path)
+}
+
+// appendFallback は送信を諦めたセグメントを CBOR シーケンスとしてファイルに追記する。
+func appendFallback(path string, seg *segment) error {
+	b, err := cbor.Marshal(seg)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
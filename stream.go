@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tai-kun/surreallog/internal/ansi"
+	"github.com/tai-kun/surreallog/internal/ghc"
+)
+
+func splitFunc(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\n':
+			if i > 0 && data[i-1] == '\r' {
+				return i + 1, data[:i-1], nil // CRLF
+			}
+
+			return i + 1, data[:i], nil // LF
+
+		case '\r':
+			if i == len(data)-1 || data[i+1] != '\n' {
+				return i + 1, data[:i], nil // CR
+			}
+		}
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+var masking = []byte("***")
+
+// masker は stdout と stderr で ::add-mask:: の値を共有する。
+type masker struct {
+	masks [][]byte
+	mu    sync.RWMutex
+}
+
+func (m *masker) add(v []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.masks = append(m.masks, bytes.Clone(v))
+}
+
+func (m *masker) mask(s []byte) []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, v := range m.masks {
+		s = bytes.ReplaceAll(s, v, masking)
+	}
+
+	return s
+}
+
+// runState は stdout と stderr の読み込みで共有される実行単位の状態。
+type runState struct {
+	masks    *masker
+	outputs  map[string]string
+	state    map[string]string
+	env      map[string]string
+	summary  string
+	matchers *ghc.Matchers
+	seq      atomic.Uint64
+	wall     time.Duration // 子プロセスの起動から終了までの時間
+	mu       sync.Mutex
+}
+
+func newRunState() *runState {
+	return &runState{
+		masks:    &masker{},
+		outputs:  map[string]string{},
+		state:    map[string]string{},
+		env:      map[string]string{},
+		matchers: &ghc.Matchers{},
+	}
+}
+
+// nextSeq は実行の中で単調に増加する行の通し番号を返す。
+func (rs *runState) nextSeq() uint64 {
+	return rs.seq.Add(1)
+}
+
+func (rs *runState) set(m map[string]string, k, v string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	m[k] = v
+}
+
+func (rs *runState) setSummary(v string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.summary = v
+}
+
+// maskedSummary はマスクを適用したステップの要約を返す。
+func (rs *runState) maskedSummary() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return string(rs.masks.mask([]byte(rs.summary)))
+}
+
+// values は m にマスクを適用したコピーを返す。m が空の場合は nil を返す。
+func (rs *runState) values(m map[string]string) map[string]string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(m) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = string(rs.masks.mask([]byte(v)))
+	}
+
+	return out
+}
+
+type reader struct {
+	fd1      bool
+	masks    *masker
+	rs       *runState
+	enable   bool
+	endtoken string
+	echo     bool
+}
+
+// command はワークフローコマンドを処理する。コマンドとして扱われた場合は
+// true を返す。このとき記録する行がなければ *line は nil になる。
+func (r *reader) command(s []byte) (*line, bool) {
+	c, _ := ghc.PraseGHC(s)
+	if c == nil {
+		return nil, false
+	}
+
+	switch c.Name {
+	case "debug":
+		c.OmitOpts()
+		c.Data = r.masks.mask(c.Data)
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		return cc, true
+
+	case "notice", "warning", "error":
+		c.Data = r.masks.mask(c.Data)
+		annotationOptions(c.Opts)
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		return cc, true
+
+	case "group":
+		c.Data = r.masks.mask(c.Data)
+		c.OmitOpts()
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		return cc, true
+
+	case "endgroup":
+		c.NameOnly()
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		return cc, true
+
+	case "add-mask":
+		if len(c.Data) > 0 && len(ghc.TrimLeftSpace(c.Data)) > 0 {
+			r.masks.add(c.Data)
+			return nil, true
+		}
+
+	case "set-output", "save-state":
+		c.Opts.String("name")
+		o, err := c.Opts.Map()
+		if err != nil || o["name"] == nil || o["name"] == "" {
+			break
+		}
+
+		m := r.rs.outputs
+		if c.Name == "save-state" {
+			m = r.rs.state
+		}
+		r.rs.set(m, o["name"].(string), string(c.Data))
+		return nil, true
+
+	case "echo":
+		switch string(c.Data) {
+		case "on":
+			r.echo = true
+		case "off":
+			r.echo = false
+		default:
+			return nil, false
+		}
+		return nil, true
+
+	case "add-path":
+		if len(c.Data) == 0 {
+			break
+		}
+
+		p := string(r.masks.mask(c.Data))
+		c.NameOnly()
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		cc.opts["path"] = p
+		return cc, true
+
+	case "add-matcher":
+		path := strings.TrimSpace(string(c.Data))
+		if path == "" {
+			break
+		}
+
+		if err := r.rs.matchers.Add(path); err != nil {
+			slog.Warn("add-matcher: " + err.Error())
+		}
+		return nil, true
+
+	case "remove-matcher":
+		c.Opts.String("owner")
+		o, err := c.Opts.Map()
+		if err != nil || o["owner"] == nil || o["owner"] == "" {
+			break
+		}
+
+		r.rs.matchers.Remove(o["owner"].(string))
+		return nil, true
+
+	case "stop-commands":
+		if len(ghc.TrimLeftSpace(c.Data)) == 0 {
+			break
+		}
+
+		r.enable = false
+		r.endtoken = string(c.Data)
+		c.OmitOpts()
+		c.Data = r.masks.mask(c.Data)
+		cc, err := newCommand(len(s), c)
+		if err != nil {
+			break
+		}
+		return cc, true
+	}
+
+	return nil, false
+}
+
+func annotationOptions(o *ghc.GHCOptions) {
+	o.String("title")
+	o.StringWithDefault("file", ".github")
+	o.NaturalNum("col")
+	o.NaturalNum("endColumn")
+	o.NaturalNumWithDefault("line", 1)
+	o.NaturalNumWithDefault("endLine", 1)
+}
+
+// match は問題マッチャーに一致した行を注釈のコマンドとして返す。
+func (r *reader) match(s []byte) *line {
+	c := r.rs.matchers.Match(s)
+	if c == nil {
+		return nil
+	}
+
+	annotationOptions(c.Opts)
+	c.Opts.String("fromPath")
+	c.Opts.String("code")
+	cc, err := newCommand(len(s), c)
+	if err != nil {
+		return nil
+	}
+
+	return cc
+}
+
+// resume は ::stop-commands:: で停止したコマンドの処理を、
+// 指定されたトークンがコマンドとして現れたときに再開する。
+func (r *reader) resume(s []byte) (*line, bool) {
+	c, _ := ghc.PraseGHC(s)
+	if c == nil || c.Name != r.endtoken {
+		return nil, false
+	}
+
+	r.enable = true
+	r.endtoken = ""
+	cc, err := newCommand(len(s), &ghc.GHC{
+		Name: "resume-commands",
+		Data: r.masks.mask([]byte(c.Name)),
+	})
+	if err != nil {
+		return nil, true
+	}
+
+	return cc, true
+}
+
+// rawLine は読み込んだ 1 行。長すぎる行は分割または切り詰められる。
+type rawLine struct {
+	b         []byte
+	t         time.Time // 行の最初のバイトを読み込んだ時刻
+	part      int       // 分割された行の何番目か (1 始まり)。分割されていなければ 0
+	continued bool      // 分割された行の続きがある
+	truncated bool
+	partial   bool // 改行を待たずに書き出した行の途中
+	tail      bool // 途中を書き出した行の残り
+}
+
+func (rl *rawLine) whole() bool {
+	return rl.part == 0 && !rl.truncated && !rl.partial && !rl.tail
+}
+
+func (rl *rawLine) opts() map[string]any {
+	switch {
+	case rl.truncated:
+		return map[string]any{"truncated": true}
+	case rl.partial:
+		return map[string]any{"partial": true}
+	case rl.part > 0 && rl.continued:
+		return map[string]any{"part": rl.part, "continued": true}
+	case rl.part > 0:
+		return map[string]any{"part": rl.part}
+	default:
+		return nil
+	}
+}
+
+// chunk は 1 回の Read で読み込んだバイト列とその時刻。
+type chunk struct {
+	b   []byte
+	t   time.Time
+	err error
+}
+
+// stamp は buf の end バイト目までを読み込んだ時刻。
+type stamp struct {
+	end int
+	t   time.Time
+}
+
+// lineReader は splitFunc で行を切り出す。bufio.Scanner と異なり、max バイトを
+// 超える行でも読み込みを止めずに、分割するか切り詰めて返す。
+// idle が正の場合、改行が来ないまま idle だけ経過した行の途中も返す。
+type lineReader struct {
+	c      <-chan *chunk
+	buf    []byte
+	stamps []stamp
+	max    int
+	trunc  bool
+	idle   time.Duration
+	part   int  // 分割中の行の直前に返した部分の番号
+	skip   bool // 切り詰めた行の残りを読み捨てている
+	tail   bool // 途中を書き出した行の残りを読んでいる
+	cr     bool // 直前の行が読み込んだ分の末尾の CR で終わった
+	err    error
+}
+
+func newLineReader(r io.Reader, max int, trunc bool, idle time.Duration) *lineReader {
+	c := make(chan *chunk)
+	go func() {
+		for {
+			b := make([]byte, 4096)
+			n, err := r.Read(b)
+			c <- &chunk{b: b[:n], t: time.Now(), err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return &lineReader{
+		c:     c,
+		buf:   []byte{},
+		max:   max,
+		trunc: trunc,
+		idle:  idle,
+	}
+}
+
+// cut は UTF-8 の文字の途中で分割しないように、max 以下の位置を返す。
+func cut(b []byte, max int) int {
+	if len(b) <= max {
+		return len(b)
+	}
+
+	for i := max; i > max-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(b[i]) {
+			return i
+		}
+	}
+
+	return max
+}
+
+// take は buf の先頭 n バイトを取り出し、その最初のバイトを読み込んだ時刻を返す。
+func (lr *lineReader) take(n int) ([]byte, time.Time) {
+	var t time.Time
+	if len(lr.stamps) > 0 {
+		t = lr.stamps[0].t
+	}
+
+	b := bytes.Clone(lr.buf[:n])
+	lr.buf = lr.buf[n:]
+	stamps := lr.stamps[:0]
+	for _, st := range lr.stamps {
+		st.end -= n
+		if st.end > 0 {
+			stamps = append(stamps, st)
+		}
+	}
+	lr.stamps = stamps
+
+	return b, t
+}
+
+func (lr *lineReader) next() (*rawLine, error) {
+	for {
+		// CRLF が読み込みの境界で分かれた場合、LF を空行として扱わない。
+		if lr.cr && len(lr.buf) > 0 {
+			lr.cr = false
+			if lr.buf[0] == '\n' {
+				lr.take(1)
+				continue
+			}
+		}
+
+		adv, tok, _ := splitFunc(lr.buf, lr.err != nil)
+		if adv > 0 && (len(tok) <= lr.max || lr.skip) {
+			lr.cr = adv == len(lr.buf) && lr.buf[adv-1] == '\r'
+			b, t := lr.take(adv)
+			rl := &rawLine{b: b[:len(tok)], t: t, tail: lr.tail}
+			lr.tail = false
+			switch {
+			case lr.skip:
+				lr.skip = false
+				continue
+			case lr.part > 0:
+				rl.part = lr.part + 1
+				lr.part = 0
+			}
+
+			return rl, nil
+		}
+
+		if adv > 0 || len(lr.buf) >= lr.max {
+			if lr.skip {
+				lr.take(len(lr.buf))
+			} else {
+				b, t := lr.take(cut(lr.buf, lr.max))
+				rl := &rawLine{b: b, t: t}
+				if lr.trunc {
+					rl.truncated = true
+					lr.skip = true
+				} else {
+					lr.part++
+					rl.part = lr.part
+					rl.continued = true
+				}
+
+				return rl, nil
+			}
+		}
+
+		if lr.err != nil {
+			return nil, lr.err
+		}
+
+		var (
+			timer *time.Timer
+			idle  <-chan time.Time
+		)
+		if lr.idle > 0 && len(lr.buf) > 0 && !lr.skip {
+			timer = time.NewTimer(lr.idle)
+			idle = timer.C
+		}
+
+		select {
+		case c := <-lr.c:
+			if timer != nil {
+				timer.Stop()
+			}
+			if len(c.b) > 0 {
+				lr.buf = append(lr.buf, c.b...)
+				lr.stamps = append(lr.stamps, stamp{end: len(lr.buf), t: c.t})
+			}
+			lr.err = c.err
+
+		case <-idle:
+			// 改行を待たずに、ここまでの内容を行の途中として返す。
+			b, t := lr.take(len(lr.buf))
+			lr.tail = true
+			return &rawLine{b: b, t: t, partial: true}, nil
+		}
+	}
+}
+
+func streamReader(
+	wg *sync.WaitGroup,
+	r io.Reader,
+	l chan<- *line,
+	fd1 bool,
+	rs *runState,
+	opt *options,
+) {
+	defer wg.Done()
+
+	var tee io.Writer
+	if opt.tee {
+		if fd1 {
+			tee = os.Stdout
+		} else {
+			tee = os.Stderr
+		}
+	}
+
+	m := rs.masks
+	rd := &reader{
+		fd1:    fd1,
+		masks:  m,
+		rs:     rs,
+		enable: true,
+	}
+	lr := newLineReader(r, int(opt.mls), opt.mlsTrunc, opt.plt)
+
+	// 分割された行や途中を書き出した行は、同じ行番号になる。
+	// コマンドや問題マッチャーの行も、元の行の最初のバイトを読み込んだ時刻にする。
+	lineNo, no := 1, 0
+	send := func(tl *line, rl *rawLine) {
+		tl.lineNo = no
+		tl.time = &rl.t
+		l <- tl
+	}
+
+	for {
+		rl, err := lr.next()
+		if err != nil {
+			// 子プロセスの起動に失敗するとパイプは閉じられる。
+			if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				slog.Warn(err.Error())
+				// パイプが詰まって子プロセスが止まらないように、残りを読み捨てる。
+				_, _ = io.Copy(io.Discard, r)
+			}
+			return
+		}
+
+		no = lineNo
+		if !rl.continued && !rl.partial {
+			lineNo++
+		}
+
+		s := rl.b
+		if fd1 && rl.whole() {
+			cmd := rd.command
+			if !rd.enable {
+				cmd = rd.resume
+			}
+
+			if cc, ok := cmd(s); ok {
+				if cc != nil {
+					send(cc, rl)
+				}
+				if rd.echo {
+					e := m.mask(s)
+					send(newLine(fd1, len(e), string(e)), rl)
+				}
+				teeLine(tee, s, m, opt, true)
+				continue
+			}
+		}
+
+		teeLine(tee, s, m, opt, !rl.continued && !rl.partial)
+		tl := textLine(fd1, s, m, rl.opts(), opt)
+		send(tl, rl)
+		if !rl.whole() {
+			continue
+		}
+
+		if cc := rd.match([]byte(tl.text)); cc != nil {
+			send(cc, rl)
+		}
+	}
+}
+
+// textLine はコマンドではない行を、SURREALLOG_ANSI に従ってエスケープシーケンスを
+// 処理してからマスクする。色などで分断された値もマスクできるように、マスクは
+// エスケープシーケンスを取り除いた文字列に適用する。
+func textLine(fd1 bool, s []byte, m *masker, o map[string]any, opt *options) *line {
+	if opt.ansi == "keep" {
+		s = m.mask(s)
+		tl := newLine(fd1, len(s), string(s))
+		tl.opts = o
+		return tl
+	}
+
+	text, spans := ansi.Parse(s)
+	masked := m.mask(text)
+	tl := newLine(fd1, len(masked), string(masked))
+	tl.opts = o
+
+	switch opt.ansi {
+	case "raw":
+		// 元の行をマスクしても、取り除いた文字列のマスクと一致しない場合は
+		// 値が漏れる可能性があるため、元の行は記録しない。
+		raw := m.mask(s)
+		if bytes.Equal(ansi.Strip(raw), masked) {
+			tl.data = string(raw)
+			tl.size += len(raw)
+		}
+
+	case "styles":
+		// マスクで文字数が変わると範囲がずれるため、装飾は記録しない。
+		if len(spans) > 0 && bytes.Equal(masked, text) {
+			if tl.opts == nil {
+				tl.opts = map[string]any{}
+			}
+			tl.opts["styles"] = spans
+		}
+	}
+
+	return tl
+}
+
+func teeLine(w io.Writer, s []byte, m *masker, opt *options, eol bool) {
+	if w == nil {
+		return
+	}
+
+	if opt.teeMask {
+		s = m.mask(s)
+	}
+
+	s = bytes.Clone(s)
+	if eol {
+		s = append(s, '\n')
+	}
+
+	// 出力先の書き込みに失敗してもログの記録は継続する。
+	_, _ = w.Write(s)
+}
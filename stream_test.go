@@ -0,0 +1,376 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReaderStopCommands(t *testing.T) {
+	type step struct {
+		in     string
+		ok     bool   // コマンドとして扱われた
+		name   string // 記録される行の text。空なら記録されない
+		data   string
+		enable bool // 処理後にコマンドが有効か
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stop and resume",
+			steps: []step{
+				{"::stop-commands::tok", true, "stop-commands", "tok", false},
+				{"::warning::x", false, "", "", false},
+				{"::tok::", true, "resume-commands", "tok", true},
+				{"::warning::y", true, "warning", "y", true},
+			},
+		},
+		{
+			name: "plain text while stopped",
+			steps: []step{
+				{"::stop-commands::tok", true, "stop-commands", "tok", false},
+				{"tok", false, "", "", false},
+				{"::tok", false, "", "", false},
+				{"::tok::", true, "resume-commands", "tok", true},
+			},
+		},
+		{
+			name: "token never matched",
+			steps: []step{
+				{"::stop-commands::tok", true, "stop-commands", "tok", false},
+				{"::tok2::", false, "", "", false},
+				{"::endgroup::", false, "", "", false},
+				{"::stop-commands::other", false, "", "", false},
+			},
+		},
+		{
+			name: "empty token",
+			steps: []step{
+				{"::stop-commands::", false, "", "", true},
+				{"::stop-commands::  ", false, "", "", true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := newRunState()
+			r := &reader{fd1: true, masks: rs.masks, rs: rs, enable: true}
+			for i, st := range tt.steps {
+				cmd := r.command
+				if !r.enable {
+					cmd = r.resume
+				}
+
+				l, ok := cmd([]byte(st.in))
+				if ok != st.ok {
+					t.Fatalf("step %d (%q): ok = %v, want %v", i, st.in, ok, st.ok)
+				}
+				switch {
+				case st.name == "" && l != nil:
+					t.Fatalf("step %d (%q): got line %q, want none", i, st.in, l.text)
+				case st.name != "" && l == nil:
+					t.Fatalf("step %d (%q): got no line, want %q", i, st.in, st.name)
+				case st.name != "" && (l.kind != -1 || l.text != st.name || l.data != st.data):
+					t.Fatalf(
+						"step %d (%q): got %d %q %q, want -1 %q %q",
+						i, st.in, l.kind, l.text, l.data, st.name, st.data,
+					)
+				}
+				if r.enable != st.enable {
+					t.Fatalf("step %d (%q): enable = %v, want %v", i, st.in, r.enable, st.enable)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamReaderStopCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string // kind text data
+	}{
+		{
+			name: "commands are stored as text while stopped",
+			in: []string{
+				"::stop-commands::tok",
+				"::warning::x",
+				"plain",
+				"::tok::",
+				"::warning::y",
+			},
+			want: []string{
+				"-1 stop-commands tok",
+				"1 ::warning::x ",
+				"1 plain ",
+				"-1 resume-commands tok",
+				"-1 warning y",
+			},
+		},
+		{
+			name: "token never matched",
+			in: []string{
+				"::stop-commands::tok",
+				"::add-mask::secret",
+				"secret",
+			},
+			want: []string{
+				"-1 stop-commands tok",
+				"1 ::add-mask::secret ",
+				"1 secret ",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &options{mls: 65536, ansi: "keep"}
+			ch := make(chan *line, 100)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			in := strings.NewReader(strings.Join(tt.in, "\n") + "\n")
+			streamReader(&wg, in, ch, true, newRunState(), opt)
+			close(ch)
+
+			got := []string{}
+			for l := range ch {
+				got = append(got, strconv.Itoa(l.kind)+" "+l.text+" "+l.data)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// chunkReader は 1 回の Read で chunks を 1 つずつ返す。
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+
+	return n, nil
+}
+
+// describe は rawLine を比較しやすい文字列にする。
+func describe(rl *rawLine) string {
+	s := strconv.Quote(string(rl.b))
+	if rl.part > 0 {
+		s += " part=" + strconv.Itoa(rl.part)
+	}
+	if rl.continued {
+		s += " continued"
+	}
+	if rl.truncated {
+		s += " truncated"
+	}
+	if rl.partial {
+		s += " partial"
+	}
+	if rl.tail {
+		s += " tail"
+	}
+
+	return s
+}
+
+func readLines(t *testing.T, lr *lineReader) []string {
+	t.Helper()
+
+	got := []string{}
+	for {
+		rl, err := lr.next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, describe(rl))
+	}
+}
+
+func TestLineReaderNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		max    int
+		trunc  bool
+		want   []string
+	}{
+		{
+			name:   "lines",
+			chunks: []string{"a\nb\r\nc\rd"},
+			max:    16,
+			want:   []string{`"a"`, `"b"`, `"c"`, `"d"`},
+		},
+		{
+			name:   "empty lines",
+			chunks: []string{"\n\na\n"},
+			max:    16,
+			want:   []string{`""`, `""`, `"a"`},
+		},
+		{
+			name:   "crlf across reads",
+			chunks: []string{"a\r", "\nb\n"},
+			max:    16,
+			want:   []string{`"a"`, `"b"`},
+		},
+		{
+			name:   "line across reads",
+			chunks: []string{"ab", "c", "d\ne"},
+			max:    16,
+			want:   []string{`"abcd"`, `"e"`},
+		},
+		{
+			name:   "exactly max",
+			chunks: []string{"abcd\n"},
+			max:    4,
+			want:   []string{`"abcd"`},
+		},
+		{
+			name:   "split",
+			chunks: []string{"abcdefghij\nxy\n"},
+			max:    4,
+			want: []string{
+				`"abcd" part=1 continued`,
+				`"efgh" part=2 continued`,
+				`"ij" part=3`,
+				`"xy"`,
+			},
+		},
+		{
+			name:   "split across reads",
+			chunks: []string{"abc", "defgh", "ij\n"},
+			max:    4,
+			want: []string{
+				`"abcd" part=1 continued`,
+				`"efgh" part=2 continued`,
+				`"ij" part=3`,
+			},
+		},
+		{
+			name:   "split without newline",
+			chunks: []string{"abcdef"},
+			max:    4,
+			want:   []string{`"abcd" part=1 continued`, `"ef" part=2`},
+		},
+		{
+			name:   "split keeps utf-8 characters",
+			chunks: []string{"aあい\n"},
+			max:    4,
+			want:   []string{`"aあ" part=1 continued`, `"い" part=2`},
+		},
+		{
+			name:   "truncate",
+			chunks: []string{"abcdefghij\nxy\n"},
+			max:    4,
+			trunc:  true,
+			want:   []string{`"abcd" truncated`, `"xy"`},
+		},
+		{
+			name:   "truncate across reads",
+			chunks: []string{"abcdef", "ghij", "kl\nxy\n"},
+			max:    4,
+			trunc:  true,
+			want:   []string{`"abcd" truncated`, `"xy"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &chunkReader{chunks: slices.Clone(tt.chunks)}
+			got := readLines(t, newLineReader(r, tt.max, tt.trunc, 0))
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineReaderNextIdle(t *testing.T) {
+	pr, pw := io.Pipe()
+	lr := newLineReader(pr, 16, false, 20*time.Millisecond)
+
+	next := func() string {
+		t.Helper()
+
+		rl, err := lr.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return describe(rl)
+	}
+
+	go func() {
+		pw.Write([]byte("abc"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("def\nghi"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("\n"))
+		pw.Close()
+	}()
+
+	want := []string{
+		`"abc" partial`,
+		`"def" tail`,
+		`"ghi" partial`,
+		`"" tail`,
+	}
+	for i, w := range want {
+		if got := next(); got != w {
+			t.Fatalf("line %d: got %s, want %s", i, got, w)
+		}
+	}
+
+	if _, err := lr.next(); err != io.EOF {
+		t.Fatalf("err = %v, want EOF", err)
+	}
+}
+
+func TestStreamReaderTime(t *testing.T) {
+	opt := &options{mls: 65536, ansi: "keep"}
+	ch := make(chan *line, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	pr, pw := io.Pipe()
+	start := time.Now()
+	go func() {
+		pw.Write([]byte("::warn"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("ing::x\n"))
+		pw.Close()
+	}()
+
+	streamReader(&wg, pr, ch, true, newRunState(), opt)
+	close(ch)
+
+	l := <-ch
+	if l == nil || l.kind != -1 || l.text != "warning" {
+		t.Fatalf("got %v, want a warning command", l)
+	}
+	// 行の残りを読み込んだ時刻ではなく、最初のバイトを読み込んだ時刻になる。
+	if d := l.time.Sub(start); d >= 100*time.Millisecond {
+		t.Fatalf("command row is timestamped %v after the first byte", d)
+	}
+}
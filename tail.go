@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+const (
+	FIND_RUN_QUERY = `
+SELECT record::id(id) AS key, startedAt, completedAt, layout FROM $run; -- 0`
+
+	LATEST_RUN_QUERY = `
+SELECT record::id(id) AS key, startedAt, completedAt, layout FROM catalog
+ORDER BY startedAt DESC LIMIT 1; -- 0`
+
+	// LIVE SELECT を先に始めてから既存の行を読むことで、その間に書き込まれた行を逃さない。
+	LIVE_TAIL_QUERY_TEMPLATE = `
+LIVE SELECT * FROM %s WHERE %sseq > $seq; -- 0
+LIVE SELECT * FROM catalog WHERE id = $run; -- 1`
+
+	SELECT_TAIL_QUERY_TEMPLATE = `
+SELECT seq, kind, time, text, data, opts FROM %s WHERE %sseq > $seq ORDER BY seq; -- 0
+SELECT completedAt, exitCode, signal FROM ONLY $run;                             -- 1`
+)
+
+type tailLine struct {
+	Seq  uint64         `cbor:"seq"`
+	Kind int            `cbor:"kind"`
+	Time sdb.Time       `cbor:"time"`
+	Text string         `cbor:"text"`
+	Data string         `cbor:"data"`
+	Opts map[string]any `cbor:"opts"`
+}
+
+type tailRun struct {
+	CompletedAt sdb.Time `cbor:"completedAt"`
+	ExitCode    *int     `cbor:"exitCode"`
+	Signal      string   `cbor:"signal"`
+}
+
+type tailer struct {
+	db    *sdb.SDB
+	run   *runEntry
+	tb    string
+	cond  string // shared レイアウトで実行の行に絞り込む条件
+	vars  map[string]any
+	lines sdb.UUID
+	cat   sdb.UUID
+	seq   uint64          // この seq までの行はすべて表示した
+	seen  map[uint64]bool // seq より後の表示した行
+	depth int             // グループの深さ
+	w     io.Writer
+}
+
+// print は行をストリーム、時刻、グループの深さに応じた字下げを付けて表示する。
+// 行は seq の順に書き込まれるとは限らないため、表示していない行であれば seq が
+// 前後していても表示する。
+func (t *tailer) print(l *tailLine) {
+	if l.Seq <= t.seq || t.seen[l.Seq] {
+		return
+	}
+	t.seen[l.Seq] = true
+	for t.seen[t.seq+1] {
+		delete(t.seen, t.seq+1)
+		t.seq++
+	}
+
+	stream, text := "out", l.Text
+	switch l.Kind {
+	case 2:
+		stream = "err"
+	case -1:
+		stream = "cmd"
+		switch l.Text {
+		case "endgroup":
+			if t.depth > 0 {
+				t.depth--
+			}
+			return
+		case "add-path":
+			p, _ := l.Opts["path"].(string)
+			text = "[add-path] " + p
+		default:
+			text = "[" + l.Text + "] " + l.Data
+		}
+	}
+
+	fmt.Fprintln(
+		t.w,
+		l.Time.Local().Format("2006-01-02T15:04:05.000Z07:00"),
+		stream,
+		strings.Repeat("  ", t.depth)+text,
+	)
+
+	if l.Kind == -1 && l.Text == "group" {
+		t.depth++
+	}
+}
+
+// follow は LIVE SELECT を始め、まだ表示していない行を表示する。実行が完了していれば true を返す。
+// 欠けている seq があると、それより後の行も読み直す。表示済みの行は print が読み飛ばす。
+func (t *tailer) follow(ctx context.Context) (bool, error) {
+	t.vars["seq"] = t.seq
+	q := fmt.Sprintf(LIVE_TAIL_QUERY_TEMPLATE, t.tb, t.cond)
+	r, err := t.db.QueryContext(ctx, q, t.vars)
+	if err != nil {
+		return false, err
+	}
+
+	lines, err := sdb.At[sdb.UUID](r, 0)
+	if err != nil {
+		return false, err
+	}
+	cat, err := sdb.At[sdb.UUID](r, 1)
+	if err != nil {
+		return false, err
+	}
+	t.lines, t.cat = *lines, *cat
+
+	q = fmt.Sprintf(SELECT_TAIL_QUERY_TEMPLATE, t.tb, t.cond)
+	r, err = t.db.QueryContext(ctx, q, t.vars)
+	if err != nil {
+		return false, err
+	}
+
+	ls, err := sdb.At[[]*tailLine](r, 0)
+	if err != nil {
+		return false, err
+	}
+	for _, l := range *ls {
+		t.print(l)
+	}
+
+	run, err := sdb.At[tailRun](r, 1)
+	if err != nil {
+		return false, err
+	}
+
+	return t.completed(run), nil
+}
+
+func (t *tailer) completed(run *tailRun) bool {
+	if run.CompletedAt.IsZero() {
+		return false
+	}
+
+	switch {
+	case run.Signal != "":
+		slog.Info("run " + t.run.id() + " completed with signal " + run.Signal)
+	case run.ExitCode != nil:
+		slog.Info("run " + t.run.id() + " completed with exit code " + strconv.Itoa(*run.ExitCode))
+	default:
+		slog.Info("run " + t.run.id() + " completed")
+	}
+
+	return true
+}
+
+// handle は通知を処理する。実行が完了していれば true を返す。
+func (t *tailer) handle(n *sdb.Notification) (bool, error) {
+	if n.Result == nil {
+		return false, nil
+	}
+
+	switch {
+	case n.ID == t.lines && n.Action == "CREATE":
+		var l tailLine
+		if err := cbor.Unmarshal(*n.Result, &l); err != nil {
+			return false, err
+		}
+		t.print(&l)
+
+	case n.ID == t.cat && (n.Action == "CREATE" || n.Action == "UPDATE"):
+		var run tailRun
+		if err := cbor.Unmarshal(*n.Result, &run); err != nil {
+			return false, err
+		}
+		return t.completed(&run), nil
+	}
+
+	return false, nil
+}
+
+func findRun(ctx context.Context, db *sdb.SDB, id string) (*runEntry, error) {
+	q, vars := LATEST_RUN_QUERY, map[string]any{}
+	if id != "" {
+		q = FIND_RUN_QUERY
+		vars["run"] = sdb.RecordID("catalog", id)
+	}
+
+	r, err := db.QueryContext(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := sdb.At[[]*runEntry](r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*runs) == 0 || (*runs)[0].id() == "" {
+		if id == "" {
+			return nil, errors.New("no runs found")
+		}
+		return nil, errors.New("run " + id + " not found")
+	}
+
+	return (*runs)[0], nil
+}
+
+// tailMain は surreallog tail を実行する。
+func tailMain(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		slog.Error("usage: surreallog tail <ns> <db> [run]")
+		return 1
+	}
+
+	opt, err := getConnOptions()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	ctx, stop := interruptible(context.Background())
+	defer stop()
+
+	// 読むだけなので、名前空間やデータベースを定義したりマイグレーションしたりしない。
+	opt.ns, opt.db = args[0], args[1]
+	db, err := useSurreal(ctx, opt)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer db.Close()
+
+	if v, err := getSchemaVersion(ctx, db); err != nil {
+		slog.Error(err.Error())
+		return 1
+	} else if v > schemaVersion {
+		slog.Error(
+			"database schema version " + strconv.Itoa(v) +
+				" is newer than " + strconv.Itoa(schemaVersion) +
+				", which this version of surreallog supports",
+		)
+		return 1
+	}
+
+	id := ""
+	if len(args) > 2 {
+		id = args[2]
+	}
+	run, err := findRun(ctx, db, id)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	t := &tailer{
+		db:   db,
+		run:  run,
+		tb:   sdb.QuoteIdent(run.id()),
+		vars: map[string]any{"run": sdb.RecordID("catalog", run.id())},
+		seen: map[uint64]bool{},
+		w:    os.Stdout,
+	}
+	if run.Layout == "shared" {
+		t.tb = "line"
+		t.cond = "run = $run AND "
+	}
+
+	// 再接続すると LIVE SELECT は失われるので、やり直して間の行を読む。
+	reconnected := make(chan struct{}, 1)
+	db.OnReconnect(func() {
+		select {
+		case reconnected <- struct{}{}:
+		default:
+		}
+	})
+
+	notifications := db.Notifications()
+	done, err := t.follow(ctx)
+	for err == nil && !done {
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-reconnected:
+			done, err = t.follow(ctx)
+		case n, ok := <-notifications:
+			if !ok {
+				err = sdb.ErrClosed
+				break
+			}
+			done, err = t.handle(&n)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		slog.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
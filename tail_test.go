@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+func TestTailerHandleOutOfOrder(t *testing.T) {
+	var b strings.Builder
+	tl := &tailer{
+		lines: sdb.UUID{1},
+		cat:   sdb.UUID{2},
+		seen:  map[uint64]bool{},
+		w:     &b,
+	}
+
+	now := time.Now()
+	notify := func(seq uint64) {
+		t.Helper()
+
+		raw, err := cbor.Marshal(map[string]any{
+			"seq":  seq,
+			"kind": 1,
+			"time": cbor.Tag{Number: 12, Content: []int64{now.Unix(), 0}},
+			"text": "line " + strconv.FormatUint(seq, 10),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := cbor.RawMessage(raw)
+		n := &sdb.Notification{ID: tl.lines, Action: "CREATE", Result: &msg}
+		if _, err := tl.handle(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stdout と stderr の行や再送された行は seq の順に届くとは限らない。
+	for _, seq := range []uint64{1, 3, 2, 3, 1, 5} {
+		notify(seq)
+	}
+
+	got := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		_, text, _ := strings.Cut(l, " out ")
+		got = append(got, text)
+	}
+	want := []string{"line 1", "line 3", "line 2", "line 5"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// 再接続後は欠けている 4 より後の行を読み直す。
+	if tl.seq != 3 {
+		t.Fatalf("seq = %d, want 3", tl.seq)
+	}
+
+	notify(4)
+	notify(5)
+	if tl.seq != 5 || len(tl.seen) != 0 {
+		t.Fatalf("seq = %d, seen = %v, want 5 and none", tl.seq, tl.seen)
+	}
+	if !strings.HasSuffix(b.String(), " out line 4\n") {
+		t.Fatalf("line 4 was not printed last:\n%s", b.String())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tai-kun/surreallog/internal/sdb"
+)
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// templateFuncs はテンプレートで使える関数を返す。
+// 検出された環境の変数は、値が設定されていなければエラーを返す関数になる。
+func templateFuncs(command string, platforms map[string]map[string]string) template.FuncMap {
+	now := time.Now().UTC()
+	id := newUUID()
+	funcs := template.FuncMap{
+		"hostname": os.Hostname,
+		"env":      os.Getenv,
+		"now":      func() time.Time { return now },
+		"date":     func(layout string, t time.Time) string { return t.Format(layout) },
+		"uuid":     func() string { return id },
+		"cmd":      func() string { return filepath.Base(command) },
+		"ident":    sdb.SanitizeIdent,
+		"lower":    strings.ToLower,
+		"upper":    strings.ToUpper,
+	}
+
+	for _, def := range platformDefs {
+		for _, v := range def.vars {
+			name := v.name
+			funcs[name] = func() (string, error) {
+				if s, ok := platformVar(platforms, name); ok {
+					return s, nil
+				}
+				return "", errors.New(name + " is not available")
+			}
+		}
+	}
+
+	return funcs
+}
+
+// renderTemplate は環境変数 env の値 s をテンプレートとして評価し、
+// SurrealDB の名前として使えるかを検証する。
+func renderTemplate(env, s string, funcs template.FuncMap) (string, error) {
+	t, err := template.New(env).Option("missingkey=error").Funcs(funcs).Parse(s)
+	if err != nil {
+		return "", errors.New("env." + env + ": " + err.Error())
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, nil); err != nil {
+		return "", errors.New("env." + env + ": " + err.Error())
+	}
+
+	out := strings.TrimSpace(b.String())
+	switch {
+	case out == "":
+		return "", errors.New("env." + env + " must not be empty")
+	case !utf8.ValidString(out):
+		return "", errors.New("env." + env + " must be valid UTF-8")
+	case strings.IndexFunc(out, unicode.IsControl) >= 0:
+		return "", errors.New("env." + env + " must not contain control characters")
+	}
+
+	return out, nil
+}